@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	mgo "gopkg.in/mgo.v2"
 	bson "gopkg.in/mgo.v2/bson"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
@@ -22,19 +31,395 @@ var (
 	debug      = flag.Bool("debug", false, "debug")
 	samplePath = flag.String("sample-path", "samplefile.data", "Record all generated sample")
 	frequency  = flag.Uint64("frequency", 100000, "output frequency")
+	readMode   = flag.String("read-mode", "Eventual", "mgo consistency mode of the session, Primary, PrimaryPreferred, Secondary, SecondaryPreferred, Nearest, Eventual, Monotonic or Strong")
+	schemaPath = flag.String("schema", "", "YAML or JSON schema file of the documents, whose indexed fields are sampled instead of key0")
+	schema     *Schema
 )
 
-type Sample map[string]string
+// Schema describes the documents of -schema, the one they were generated with.
+type Schema struct {
+	Fields  []*Field `yaml:"fields"`
+	indexes []string
+	fields  map[string]*Field
+	source  string
+}
+
+type Field struct {
+	Name   string   `yaml:"name"`
+	Type   string   `yaml:"type"`
+	Count  int      `yaml:"count"`
+	Min    int64    `yaml:"min"`
+	Max    int64    `yaml:"max"`
+	Index  bool     `yaml:"index"`
+	Fields []*Field `yaml:"fields"`
+	Items  *Field   `yaml:"items"`
+}
+
+func loadSchema(path string) *Schema {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var schema Schema
+	err = yaml.Unmarshal(body, &schema)
+	if err != nil {
+		log.Fatalf("Parse schema %s failed: %s\n", path, err)
+	}
+	if len(schema.Fields) == 0 {
+		log.Fatalf("No field in schema %s\n", path)
+	}
+	for _, f := range schema.Fields {
+		if err = f.check(); err != nil {
+			log.Fatalf("Invalid schema %s: %s\n", path, err)
+		}
+	}
+	schema.source = string(body)
+	schema.fields = make(map[string]*Field)
+	schema.addIndexes("", schema.Fields)
+	if len(schema.indexes) == 0 {
+		log.Fatalf("No indexed field to query in schema %s\n", path)
+	}
+	return &schema
+}
+
+func (f *Field) check() error {
+	if f.Name == "" {
+		return fmt.Errorf("field without name")
+	}
+	if f.Count < 0 || f.Min < 0 || f.Max < f.Min {
+		return fmt.Errorf("invalid count or bounds of field %s", f.Name)
+	}
+	defaults := func(min, max int64) {
+		if f.Min == 0 && f.Max == 0 {
+			f.Min, f.Max = min, max
+		}
+	}
+	switch f.Type {
+	case "string":
+		defaults(32, 32)
+	case "int":
+		defaults(0, math.MaxInt32)
+	case "date":
+		defaults(0, 365*24*3600)
+	case "nested":
+		if len(f.Fields) == 0 {
+			return fmt.Errorf("nested field %s without fields", f.Name)
+		}
+		for _, child := range f.Fields {
+			if err := child.check(); err != nil {
+				return err
+			}
+		}
+	case "array":
+		if f.Items == nil {
+			return fmt.Errorf("array field %s without items", f.Name)
+		}
+		if f.Items.Name == "" {
+			f.Items.Name = f.Name
+		}
+		defaults(1, 5)
+		return f.Items.check()
+	default:
+		return fmt.Errorf("unknown type %q of field %s", f.Type, f.Name)
+	}
+	return nil
+}
+
+func (f *Field) names() []string {
+	if f.Count == 0 {
+		return []string{f.Name}
+	}
+	names := make([]string, f.Count)
+	for i := range names {
+		names[i] = f.Name + strconv.Itoa(i)
+	}
+	return names
+}
+
+func (s *Schema) addIndexes(prefix string, fields []*Field) {
+	for _, f := range fields {
+		for _, name := range f.names() {
+			if f.Index {
+				s.indexes = append(s.indexes, prefix+name)
+				s.fields[prefix+name] = f
+			}
+			if f.Type == "nested" {
+				s.addIndexes(prefix+name+".", f.Fields)
+			}
+		}
+	}
+}
+
+func (s *Schema) Record(doc map[string]interface{}) map[string]interface{} {
+	record := make(map[string]interface{}, len(s.indexes))
+	for _, path := range s.indexes {
+		record[path] = lookup(doc, path)
+	}
+	return record
+}
+
+func (s *Schema) recordSize() int64 {
+	size := int64(2)
+	for _, path := range s.indexes {
+		size += int64(len(path)+4) + s.fields[path].maxJSON()
+	}
+	return size + 1
+}
+
+func (f *Field) maxJSON() int64 {
+	switch f.Type {
+	case "string":
+		return f.Max + 2
+	case "int":
+		return 20
+	case "date":
+		return int64(len(`"2006-01-02T15:04:05.999999999Z07:00"`))
+	case "nested":
+		size := int64(2)
+		for _, child := range f.Fields {
+			for _, name := range child.names() {
+				size += int64(len(name)+4) + child.maxJSON()
+			}
+		}
+		return size
+	case "array":
+		return 2 + f.Max*(f.Items.maxJSON()+1)
+	}
+	return 0
+}
+
+// lookup returns the value at the dotted path of doc, nil if there is none.
+func lookup(doc map[string]interface{}, path string) interface{} {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		switch m := value.(type) {
+		case map[string]interface{}:
+			value = m[name]
+		case bson.M:
+			value = m[name]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+const (
+	sampleFormat      = "poc-sample"
+	sampleVersion     = 1
+	defaultRecordSize = 141
+)
+
+// SampleHeader is the first line of a sample file, see api-benchmark-real.go.
+type SampleHeader struct {
+	Format     string   `json:"format"`
+	Version    int      `json:"version"`
+	HeaderSize int64    `json:"header_size"`
+	RecordSize int64    `json:"record_size"`
+	Count      int64    `json:"count"`
+	Seed       int64    `json:"seed"`
+	Schema     string   `json:"schema"`
+	Fields     []string `json:"fields"`
+	Partitions int      `json:"partitions"`
+}
+
+func newSampleHeader(schema *Schema, seed int64) SampleHeader {
+	header := SampleHeader{
+		Format:     sampleFormat,
+		Version:    sampleVersion,
+		RecordSize: defaultRecordSize,
+		Seed:       seed,
+		Fields:     []string{"key0"},
+		Partitions: 1,
+	}
+	if schema != nil {
+		header.RecordSize = schema.recordSize()
+		header.Schema = schema.source
+		header.Fields = schema.indexes
+	}
+	return header
+}
+
+func (h *SampleHeader) encode() ([]byte, error) {
+	line, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(line)) >= h.HeaderSize {
+		return nil, fmt.Errorf("sample header of %d bytes doesn't fit in %d", len(line), h.HeaderSize)
+	}
+	buf := bytes.Repeat([]byte{' '}, int(h.HeaderSize))
+	copy(buf, line)
+	buf[len(buf)-1] = '\n'
+	return buf, nil
+}
 
-func writer(source <-chan string, done chan<- bool) {
+func readSampleHeader(r io.ReaderAt, size int64) (*SampleHeader, int64, error) {
+	buf := make([]byte, 1<<20)
+	if size < int64(len(buf)) {
+		buf = buf[:size]
+	}
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	end := bytes.IndexByte(buf[:n], '\n')
+	var header SampleHeader
+	if end < 0 || json.Unmarshal(buf[:end], &header) != nil || header.Format != sampleFormat {
+		return nil, 0, fmt.Errorf("not a sample file")
+	}
+	if header.Version != sampleVersion {
+		return nil, 0, fmt.Errorf("unsupported sample file version %d", header.Version)
+	}
+	if header.HeaderSize != int64(end+1) || header.RecordSize <= 0 || len(header.Fields) == 0 {
+		return nil, 0, fmt.Errorf("invalid sample file header")
+	}
+	if header.Partitions == 0 {
+		header.Partitions = 1
+	}
+
+	records := (size - header.HeaderSize) / header.RecordSize
+	if partial := (size - header.HeaderSize) % header.RecordSize; partial != 0 {
+		log.Printf("Ignoring a partial record of %d bytes at the end of the sample file\n", partial)
+	}
+	if records < header.Count {
+		return nil, 0, fmt.Errorf("sample file has %d records, its header %d", records, header.Count)
+	}
+	if records > header.Count {
+		log.Printf("Sample file has %d records more than its header, it wasn't closed\n", records-header.Count)
+	}
+	return &header, records, nil
+}
+
+type SampleWriter struct {
+	lock   sync.Mutex
+	file   *os.File
+	header SampleHeader
+}
+
+func OpenSampleWriter(path string, header SampleHeader, readOnly bool) (*SampleWriter, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		line, _ := json.Marshal(&header)
+		header.HeaderSize = (int64(len(line))/512 + 1) * 512
+	} else {
+		existing, records, err := readSampleHeader(file, info.Size())
+		if err == nil && (existing.Schema != header.Schema || existing.RecordSize != header.RecordSize) {
+			err = fmt.Errorf("sample file of another schema or record size")
+		}
+		if err == nil && !readOnly && existing.Seed != header.Seed {
+			err = fmt.Errorf("sample file of seed %d, not %d", existing.Seed, header.Seed)
+		}
+		if err == nil && existing.Partitions != header.Partitions {
+			err = fmt.Errorf("sample file of %d partitions, not %d", existing.Partitions, header.Partitions)
+		}
+		if err == nil {
+			existing.Count = records
+			err = file.Truncate(existing.HeaderSize + records*existing.RecordSize)
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		header = *existing
+	}
+
+	w := &SampleWriter{file: file, header: header}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *SampleWriter) pad(line []byte) ([]byte, error) {
+	if int64(len(line)) >= w.header.RecordSize {
+		return nil, fmt.Errorf("sample record of %d bytes doesn't fit in %d", len(line), w.header.RecordSize)
+	}
+	buf := bytes.Repeat([]byte{' '}, int(w.header.RecordSize))
+	copy(buf, line)
+	buf[len(buf)-1] = '\n'
+	return buf, nil
+}
+
+func (w *SampleWriter) Write(records []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n, err := w.file.WriteAt(records, w.header.HeaderSize+w.header.Count*w.header.RecordSize)
+	written := int64(n) / w.header.RecordSize
+	w.header.Count += written
+	return int(written), err
+}
+
+func (w *SampleWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	buf, err := w.header.encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.file.WriteAt(buf, 0)
+	return err
+}
+
+func (w *SampleWriter) Close() error {
+	err := w.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readModes are the mgo consistency modes by their lowercase names.
+var readModes = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primarypreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondarypreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+	"eventual":           mgo.Eventual,
+	"monotonic":          mgo.Monotonic,
+	"strong":             mgo.Strong,
+}
+
+// parseReadMode returns the mgo mode named name, in any case.
+func parseReadMode(name string) (mgo.Mode, error) {
+	mode, ok := readModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown read mode %s", name)
+	}
+	return mode, nil
+}
+
+type Sample map[string]interface{}
+
+func writer(source <-chan map[string]interface{}, done chan<- bool) {
 	defer close(done)
-	sampleFile, err := os.OpenFile(*samplePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	sampleWriter, err := OpenSampleWriter(*samplePath, newSampleHeader(schema, 0), false)
 	if err != nil {
 		panic(err)
 	}
-	defer sampleFile.Close()
-	for key := range source {
-		sampleFile.WriteString(key)
+	defer sampleWriter.Close()
+	for record := range source {
+		line, err := json.Marshal(record)
+		if err == nil {
+			line, err = sampleWriter.pad(line)
+		}
+		if err == nil {
+			_, err = sampleWriter.Write(line)
+		}
+		if err != nil {
+			panic(err)
+		}
 	}
 	done <- true
 }
@@ -49,6 +434,10 @@ func main() {
 		mgo.SetDebug(*debug)
 	}
 
+	mode, err := parseReadMode(*readMode)
+	if err != nil {
+		panic(err)
+	}
 	session, err := mgo.DialWithTimeout(*mongoUrl, 1*time.Minute)
 	if err != nil {
 		panic(err)
@@ -56,23 +445,41 @@ func main() {
 	defer session.Close()
 	session.SetSyncTimeout(30 * time.Minute)
 	session.SetSocketTimeout(30 * time.Minute)
-	session.SetMode(mgo.Eventual, true)
+	session.SetMode(mode, true)
 	session.SetPrefetch(*prefetch)
 	session.SetBatch(*batch)
 
-	docInputChannel := make(chan string, 1024)
+	if *schemaPath != "" {
+		schema = loadSchema(*schemaPath)
+	}
+
+	docInputChannel := make(chan map[string]interface{}, 1024)
 	writerDone := make(chan bool, 1)
 
 	go writer(docInputChannel, writerDone)
 
 	collection := session.DB(*mongoDb).C(*mongoColl)
 
-	var sample Sample
+	selector := bson.M{"key0": 1}
+	if schema != nil {
+		selector = bson.M{}
+		for _, path := range schema.indexes {
+			selector[path] = 1
+		}
+	}
 
 	counter := uint64(0)
-	iter := collection.Find(nil).Select(bson.M{"key0": 1}).Iter()
-	for iter.Next(&sample) {
-		docInputChannel <- sample["key0"]
+	iter := collection.Find(nil).Select(selector).Iter()
+	for {
+		var sample Sample
+		if !iter.Next(&sample) {
+			break
+		}
+		if schema != nil {
+			docInputChannel <- schema.Record(sample)
+		} else {
+			docInputChannel <- map[string]interface{}{"key0": sample["key0"]}
+		}
 		counter += 1
 		if counter%(*frequency) == 0 {
 			fmt.Printf("Sync %d records\n", counter)
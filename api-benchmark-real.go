@@ -2,300 +2,2572 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
 	uuid "github.com/pborman/uuid"
 	murmur3 "github.com/spaolacci/murmur3"
 	mmap "golang.org/x/exp/mmap"
 	mgo "gopkg.in/mgo.v2"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
-	NumberGoroutine     = flag.Int("n", 1, "number of goruntine")
-	url                 = flag.String("url", "http://127.0.0.1", "url")
-	writeCount          = flag.Uint64("qw", 0, "number of write")
-	queryCount          = flag.Uint64("qr", 0, "number of query")
-	frequency           = flag.Uint64("frequency", 100000, "benchmark frequency")
-	mongoHost           = flag.String("mongo", "127.0.0.1", "mongo host")
-	mongoDb             = flag.String("d", "test", "mongo db")
-	mongoColl           = flag.String("c", "test", "mongo coll")
-	samplePath          = flag.String("sample-path", "samplefile.data", "Record all generated sample")
-	sampleFile          *os.File
-	totalWrite          = uint64(0)
-	totalQuery          = uint64(0)
-	last                time.Time
-	sampleMemoryFile    *mmap.ReaderAt
-	sampleMemoryFileLen int
+	NumberGoroutine  = flag.Int("n", 1, "number of goruntine")
+	url              = flag.String("url", "http://127.0.0.1", "url")
+	writeCount       = flag.Uint64("qw", 0, "number of write")
+	queryCount       = flag.Uint64("qr", 0, "number of query")
+	mixedCount       = flag.Uint64("qm", 0, "number of mixed query and write")
+	readRatio        = flag.Float64("read-ratio", 0.8, "ratio of queries in mixed mode")
+	rywCount         = flag.Uint64("ryw", 0, "number of read-your-writes checks, each writes a document and queries it until visible")
+	readMode         = flag.String("read-mode", "", "read mode of the queries, sent in the X-Mongo-Read-Mode header to override -read-mode of api-server-real, e.g. SecondaryPreferred")
+	rywSession       = flag.String("ryw-session", "any", "session of the -ryw queries relative to the write, same, other or any for the round-robin of the server")
+	rywTimeout       = flag.Duration("ryw-timeout", 10*time.Second, "max time a -ryw document may stay invisible before it counts as lost")
+	rywPoll          = flag.Duration("ryw-poll", time.Millisecond, "delay between the queries of a -ryw document which is not visible yet")
+	agentAddr        = flag.String("agent", "", "run as an agent listening on this addr for workloads of a coordinator")
+	agentAddrs       = flag.String("agents", "", "run as a coordinator of the agents at these comma separated addrs")
+	agentTimeout     = flag.Duration("agent-timeout", 0, "max time the coordinator waits for the result of an agent, 0 means -start-delay plus the length of the -duration phases and a minute, or an hour without -duration")
+	startDelay       = flag.Duration("start-delay", 2*time.Second, "delay between sending a workload to agents and its synchronized start")
+	verify           = flag.Bool("verify", false, "check the documents returned by queries match them and the key scheme of generateRandomHexes")
+	seed             = flag.Int64("seed", 0, "seed of the generated documents and queries of every worker, 0 means a random one; the queries of -qm, -ryw, -saturate and scenarios also depend on the keys written so far")
+	missRatio        = flag.Float64("miss-ratio", 0, "fraction of queries for keys known not to exist, reported apart from hits")
+	distribution     = flag.String("distribution", "uniform", "distribution of queried sample records, uniform, zipfian, latest or hotspot")
+	zipfTheta        = flag.Float64("zipf-theta", 0.99, "skew of the zipfian and latest distributions, in (0, 1)")
+	hotFraction      = flag.Float64("hot-fraction", 0.2, "fraction of sample records which are hot in the hotspot distribution")
+	hotOps           = flag.Float64("hot-ops", 0.8, "fraction of queries for hot records in the hotspot distribution")
+	schemaPath       = flag.String("schema", "", "generate the documents described by this YAML or JSON schema file instead of 20 hex keys")
+	scenarioPath     = flag.String("scenario", "", "run the phases of this YAML or JSON scenario file instead of -qw, -qr and -qm")
+	saturateMode     = flag.String("saturate", "", "step rate or concurrency up until -slo or -max-error-ratio is breached, with rate -n workers send the requests so too few of them breach -slo")
+	rampMode         = flag.String("ramp", "stepped", "how -saturate moves between steps, stepped or linear")
+	stepStart        = flag.Float64("step-start", 100, "rate or concurrency of the first -saturate step")
+	stepSize         = flag.Float64("step-size", 100, "increase of rate or concurrency of each -saturate step")
+	stepDuration     = flag.Duration("step-duration", 10*time.Second, "length of each -saturate step")
+	maxSteps         = flag.Int("max-steps", 100, "max number of -saturate steps")
+	sloPercentile    = flag.Float64("slo-percentile", 99, "latency percentile checked against -slo")
+	slo              = flag.Duration("slo", 100*time.Millisecond, "latency SLO of -saturate")
+	maxErrorRatio    = flag.Float64("max-error-ratio", 0.01, "max ratio of failed requests of -saturate")
+	recentKeysMax    = flag.Int("recent-keys", 1000000, "max number of keys written in mixed mode kept for queries, 0 keeps none")
+	frequency        = flag.Uint64("frequency", 100000, "benchmark frequency")
+	rate             = flag.Float64("rate", 0, "target requests per second of all goroutines, 0 means closed-loop")
+	arrival          = flag.String("arrival", "constant", "arrival of requests in -rate mode, constant or poisson")
+	duration         = flag.Duration("duration", 0, "measured length of each phase, 0 means bounded by counts only")
+	warmup           = flag.Duration("warmup", 0, "length of the unrecorded window before measurement")
+	cooldown         = flag.Duration("cooldown", 0, "length of the unrecorded window after -duration")
+	interval         = flag.Duration("interval", time.Second, "sampling interval of the throughput time series")
+	resultJSON       = flag.String("result-json", "", "write the result document of the run to this JSON file")
+	resultCSV        = flag.String("result-csv", "", "write the summary and throughput time series of the run to this CSV file")
+	mongoHost        = flag.String("mongo", "127.0.0.1", "mongo host, leave empty to skip ensuring indexes")
+	mongoDb          = flag.String("d", "test", "mongo db")
+	mongoColl        = flag.String("c", "test", "mongo coll")
+	samplePath       = flag.String("sample-path", "samplefile.data", "Record all generated sample")
+	sampleBatch      = flag.Int("sample-batch", 1024, "number of sample records per write")
+	sampleFlush      = flag.Duration("sample-flush", time.Second, "interval of updating the sample file header")
+	sampleSync       = flag.String("sample-sync", "flush", "when to fsync the sample file, none, flush (every -sample-flush) or close")
+	recorder         *SampleRecorder
+	totalWrite       = uint64(0)
+	totalQuery       = uint64(0)
+	totalMixed       = uint64(0)
+	workerSeq        = uint64(0)
+	agentIndex       = 0
+	totalRYW         = uint64(0)
+	cancelled        = int32(0)
+	last             = int64(0)
+	phase            *Phase
+	result           *Result
+	pacer            *Pacer
+	setFlags         map[string]bool
+	sampleMemoryFile *mmap.ReaderAt
+	samples          *SampleReader
+	recentKeys       *KeyPool
+	chooser          Chooser
+	schema           *Schema
+	queryMinKeys     = 1
+	queryMaxKeys     = 5
 )
 
-type Doc map[string]string
+type Doc map[string]interface{}
 
-func generateMurmur3() []byte {
+// invalidResponse is the error code of responses which failed -verify.
+const invalidResponse = -1
+
+// Stats collects the latencies and failures of one operation type.
+// Each worker owns its Stats, they are merged once all workers are done.
+type Stats struct {
+	Latency *hdrhistogram.Histogram
+	// Sampler, if set, counts every completed operation including those
+	// outside the measurement window.
+	Sampler *Sampler
+	// Errors counts failures by HTTP status code, 0 means the request failed
+	// before any response was received and invalidResponse that the response
+	// failed -verify.
+	Errors map[int]uint64
+	// Misses holds the queries for keys known not to exist, nil if there
+	// were none.
+	Misses *Stats
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		Latency: hdrhistogram.New(1, int64(time.Hour/time.Microsecond), 3),
+		Errors:  make(map[int]uint64),
+	}
+}
+
+// Record records the latency of an operation started at start, unless it
+// started outside the measurement window of the current phase.
+func (s *Stats) Record(start time.Time) {
+	if s.Sampler != nil {
+		s.Sampler.Add()
+	}
+	if phase.Measuring(start) {
+		s.Latency.RecordValue(int64(time.Since(start) / time.Microsecond))
+	}
+}
+
+func (s *Stats) RecordError(start time.Time, code int) {
+	if phase.Measuring(start) {
+		s.Errors[code]++
+	}
+}
+
+// MissStats returns the Stats of negative lookups, creating it on first use.
+func (s *Stats) MissStats() *Stats {
+	if s.Misses == nil {
+		s.Misses = NewStats()
+		s.Misses.Sampler = s.Sampler
+	}
+	return s.Misses
+}
+
+func (s *Stats) Merge(other *Stats) {
+	s.Latency.Merge(other.Latency)
+	for code, n := range other.Errors {
+		s.Errors[code] += n
+	}
+	if other.Misses != nil {
+		s.MissStats().Merge(other.Misses)
+	}
+}
+
+func mergeStats(all []*Stats) *Stats {
+	merged := NewStats()
+	for _, s := range all {
+		merged.Merge(s)
+	}
+	return merged
+}
+
+func (s *Stats) Report(op string, elapsed time.Duration) {
+	ms := func(q float64) float64 {
+		return float64(s.Latency.ValueAtQuantile(q)) / 1000
+	}
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(s.Latency.TotalCount()) / elapsed.Seconds()
+	}
+	log.Printf("%s count=%d rate=%.1f/s p50=%.3fms p90=%.3fms p99=%.3fms p99.9=%.3fms max=%.3fms\n",
+		op, s.Latency.TotalCount(), rate, ms(50), ms(90), ms(99), ms(99.9), float64(s.Latency.Max())/1000)
+
+	codes := make([]int, 0, len(s.Errors))
+	for code := range s.Errors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		if code == invalidResponse {
+			log.Printf("%s errors invalid count=%d\n", op, s.Errors[code])
+			continue
+		}
+		log.Printf("%s errors status=%d count=%d\n", op, code, s.Errors[code])
+	}
+}
+
+// Sampler counts completed operations and samples the count every -interval
+// to build a throughput time series.
+type Sampler struct {
+	ops       uint64
+	last      time.Time
+	lastOps   uint64
+	start     time.Time
+	intervals []Interval
+	stop      chan bool
+	done      chan bool
+}
+
+func StartSampler() *Sampler {
+	now := time.Now()
+	s := &Sampler{start: now, last: now, stop: make(chan bool), done: make(chan bool)}
+	go s.run()
+	return s
+}
+
+func (s *Sampler) Add() {
+	atomic.AddUint64(&s.ops, 1)
+}
+
+func (s *Sampler) run() {
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sample(now)
+		case <-s.stop:
+			s.sample(time.Now())
+			close(s.done)
+			return
+		}
+	}
+}
+
+func (s *Sampler) sample(now time.Time) {
+	ops := atomic.LoadUint64(&s.ops)
+	s.intervals = append(s.intervals, Interval{
+		End:   now.Sub(s.start).Seconds(),
+		Count: ops - s.lastOps,
+		Rate:  float64(ops-s.lastOps) / now.Sub(s.last).Seconds(),
+	})
+	s.last, s.lastOps = now, ops
+}
+
+// Stop stops sampling and returns the time series.
+func (s *Sampler) Stop() []Interval {
+	close(s.stop)
+	<-s.done
+	return s.intervals
+}
+
+type Interval struct {
+	End   float64 `json:"end_seconds"`
+	Count uint64  `json:"count"`
+	Rate  float64 `json:"rate"`
+}
+
+// Result is the machine-readable outcome of a run, written by -result-json
+// and -result-csv.
+type Result struct {
+	Program    string            `json:"program"`
+	Start      time.Time         `json:"start"`
+	Flags      map[string]string `json:"flags"`
+	Ops        []*OpResult       `json:"ops"`
+	Saturation *Saturation       `json:"saturation,omitempty"`
+	// Interrupted is set when a signal or the coordinator stopped the run
+	// early, leaving phases short or skipped.
+	Interrupted bool `json:"interrupted,omitempty"`
+	// FailedAgents lists the agents the coordinator got no result from.
+	FailedAgents []string `json:"failed_agents,omitempty"`
+}
+
+// Saturation is the outcome of -saturate, Level is the rate or concurrency
+// of the step that reached Throughput.
+type Saturation struct {
+	Mode       string  `json:"mode"`
+	Level      float64 `json:"level"`
+	Throughput float64 `json:"throughput"`
+}
+
+type OpResult struct {
+	Phase     string             `json:"phase"`
+	Op        string             `json:"op"`
+	Count     int64              `json:"count"`
+	Elapsed   float64            `json:"elapsed_seconds"`
+	Rate      float64            `json:"rate"`
+	Latency   map[string]float64 `json:"latency_ms"`
+	Errors    map[int]uint64     `json:"errors"`
+	Intervals []Interval         `json:"intervals"`
+	// Histogram is the latency histogram in microseconds in the base64
+	// HdrHistogram V2 compressed encoding.
+	Histogram string `json:"histogram"`
+}
+
+func NewResult(program string) *Result {
+	r := &Result{Program: program, Start: time.Now(), Flags: make(map[string]string)}
+	flag.VisitAll(func(f *flag.Flag) {
+		r.Flags[f.Name] = f.Value.String()
+	})
+	return r
+}
+
+var percentiles = []struct {
+	name     string
+	quantile float64
+}{{"p50", 50}, {"p90", 90}, {"p99", 99}, {"p99.9", 99.9}}
+
+func (r *Result) Add(phaseName, op string, stats *Stats, elapsed time.Duration, intervals []Interval) {
+	opResult := &OpResult{
+		Phase:     phaseName,
+		Op:        op,
+		Count:     stats.Latency.TotalCount(),
+		Elapsed:   elapsed.Seconds(),
+		Latency:   make(map[string]float64),
+		Errors:    stats.Errors,
+		Intervals: intervals,
+	}
+	if encoded, err := stats.Latency.Encode(hdrhistogram.V2CompressedEncodingCookieBase); err == nil {
+		opResult.Histogram = string(encoded)
+	} else {
+		log.Println("Encode histogram failed", err)
+	}
+	if elapsed > 0 {
+		opResult.Rate = float64(opResult.Count) / elapsed.Seconds()
+	}
+	for _, p := range percentiles {
+		opResult.Latency[p.name] = float64(stats.Latency.ValueAtQuantile(p.quantile)) / 1000
+	}
+	opResult.Latency["max"] = float64(stats.Latency.Max()) / 1000
+	opResult.Latency["mean"] = stats.Latency.Mean() / 1000
+	r.Ops = append(r.Ops, opResult)
+}
+
+func (r *Result) WriteJSON(path string) error {
+	body, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, body, 0644)
+}
+
+// WriteCSV writes one summary row per operation followed by one row per
+// interval of its time series, which leaves the latency columns empty.
+func (r *Result) WriteCSV(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	header := []string{"phase", "op", "interval_end_seconds", "count", "rate"}
+	for _, p := range percentiles {
+		header = append(header, p.name+"_ms")
+	}
+	header = append(header, "max_ms", "mean_ms", "errors")
+	w.Write(header)
+
+	for _, op := range r.Ops {
+		errors := uint64(0)
+		for _, n := range op.Errors {
+			errors += n
+		}
+		row := []string{op.Phase, op.Op, "total", strconv.FormatInt(op.Count, 10), formatFloat(op.Rate)}
+		for _, p := range percentiles {
+			row = append(row, formatFloat(op.Latency[p.name]))
+		}
+		row = append(row, formatFloat(op.Latency["max"]), formatFloat(op.Latency["mean"]), strconv.FormatUint(errors, 10))
+		w.Write(row)
+
+		for _, interval := range op.Intervals {
+			row := []string{op.Phase, op.Op, formatFloat(interval.End), strconv.FormatUint(interval.Count, 10), formatFloat(interval.Rate)}
+			for i := 0; i < len(percentiles)+3; i++ {
+				row = append(row, "")
+			}
+			w.Write(row)
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
+
+// report logs the outcome of one operation type of the current phase and
+// adds it to the result document.
+func report(phaseName, op string, stats *Stats, sampler *Sampler) {
+	elapsed := phase.Elapsed()
+	stats.Report(op, elapsed)
+	result.Add(phaseName, op, stats, elapsed, sampler.Stop())
+	if stats.Misses != nil {
+		stats.Misses.Report(op+" miss", elapsed)
+		result.Add(phaseName, op+" miss", stats.Misses, elapsed, nil)
+	}
+}
+
+func writeResult() {
+	result.Interrupted = result.Interrupted || stopped()
+	if *resultJSON != "" {
+		if err := result.WriteJSON(*resultJSON); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *resultCSV != "" {
+		if err := result.WriteCSV(*resultCSV); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Phase bounds one benchmark phase in time. Operations started during the
+// warmup or cooldown windows are sent but not recorded.
+type Phase struct {
+	measureFrom time.Time
+	measureTo   time.Time
+	end         time.Time
+}
+
+func NewPhase(duration, warmup, cooldown time.Duration) *Phase {
+	p := &Phase{measureFrom: time.Now().Add(warmup)}
+	if duration > 0 {
+		p.measureTo = p.measureFrom.Add(duration)
+		p.end = p.measureTo.Add(cooldown)
+	}
+	return p
+}
+
+// Over reports whether a duration-based phase has finished, or the run has
+// been stopped.
+func (p *Phase) Over() bool {
+	return stopped() || (!p.end.IsZero() && time.Now().After(p.end))
+}
+
+// Measuring reports whether an operation started at t should be recorded.
+func (p *Phase) Measuring(t time.Time) bool {
+	return !t.Before(p.measureFrom) && (p.measureTo.IsZero() || t.Before(p.measureTo))
+}
+
+// Elapsed returns how long the measurement window has lasted so far.
+func (p *Phase) Elapsed() time.Duration {
+	to := time.Now()
+	if !p.measureTo.IsZero() && to.After(p.measureTo) {
+		to = p.measureTo
+	}
+	if to.Before(p.measureFrom) {
+		return 0
+	}
+	return to.Sub(p.measureFrom)
+}
+
+// phaseEnabled reports whether the phase counted by the flag name should run.
+// With -duration, giving the flag at all enables it and 0 means no count limit.
+func phaseEnabled(name string, count uint64) bool {
+	return !stopped() && (count > 0 || (*duration > 0 && setFlags[name]))
+}
+
+// stopping is closed by the first SIGINT or SIGTERM. It ends the current
+// phase and skips the next ones, so the requests in flight drain and the run
+// still records its samples and reports what it has measured. A second signal
+// exits at once.
+var stopping = make(chan struct{})
+
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Got %s, stopping after the requests in flight, again to exit now\n", sig)
+		close(stopping)
+		<-signals
+		os.Exit(1)
+	}()
+}
+
+// stopped reports whether the run has been stopped by a signal, or by the
+// coordinator for an agent.
+func stopped() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return atomic.LoadInt32(&cancelled) != 0
+	}
+}
+
+// Pacer hands out the intended start times of an open-loop schedule shared
+// by all workers, so a slow response doesn't delay the requests behind it.
+type Pacer struct {
+	lock     sync.Mutex
+	start    time.Time
+	next     time.Time
+	rateFrom float64
+	rateTo   float64
+	over     time.Duration
+	poisson  bool
+	rnd      *rand.Rand
+}
+
+// NewPacer returns nil when rate is not positive, which means closed-loop.
+func NewPacer(rate float64, arrival string) *Pacer {
+	return NewRampPacer(rate, rate, 0, arrival)
+}
+
+// NewRampPacer changes the rate linearly from rateFrom to rateTo over the
+// given duration and keeps rateTo afterwards.
+func NewRampPacer(rateFrom, rateTo float64, over time.Duration, arrival string) *Pacer {
+	if rateFrom <= 0 && rateTo <= 0 {
+		return nil
+	}
+	now := time.Now()
+	pacer := &Pacer{
+		start:    now,
+		next:     now,
+		rateFrom: rateFrom,
+		rateTo:   rateTo,
+		over:     over,
+	}
+	switch arrival {
+	case "constant":
+	case "poisson":
+		pacer.poisson = true
+		pacer.rnd = newRand()
+	default:
+		log.Fatalf("Unknown arrival %s\n", arrival)
+	}
+	return pacer
+}
+
+// gap returns the mean time between two starts at the current point of the
+// schedule, the rate never goes below one operation per second.
+func (p *Pacer) gap() time.Duration {
+	rate := p.rateTo
+	if elapsed := p.next.Sub(p.start); elapsed < p.over {
+		rate = p.rateFrom + (p.rateTo-p.rateFrom)*float64(elapsed)/float64(p.over)
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// Wait blocks until the next intended start time and returns it. Latency
+// should be measured from the returned time so that queueing behind slow
+// requests is counted. A nil Pacer returns the current time immediately.
+func (p *Pacer) Wait() time.Time {
+	if p == nil {
+		return time.Now()
+	}
+	p.lock.Lock()
+	start := p.next
+	if p.poisson {
+		p.next = p.next.Add(time.Duration(p.rnd.ExpFloat64() * float64(p.gap())))
+	} else {
+		p.next = p.next.Add(p.gap())
+	}
+	p.lock.Unlock()
+
+	if d := start.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+	return start
+}
+
+// logThroughput logs the rate of the last frequency operations.
+func logThroughput(op string, t uint64) {
+	now := time.Now().UnixNano()
+	prev := atomic.SwapInt64(&last, now)
+	log.Println(op, t, float64(*frequency)/time.Duration(now-prev).Seconds())
+}
+
+// newRand returns the random source of the next worker or poisson Pacer. With
+// -seed a worker only depends on the seed, the agent and the order workers are
+// started in, so its documents and queries are the same in every run. The
+// queries of -qm, -ryw, -saturate and scenarios are the exception, they also
+// pick among the keys written so far by all workers, which depends on timing.
+func newRand() *rand.Rand {
+	s := *seed
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	var buf [24]byte
+	binary.LittleEndian.PutUint64(buf[0:], uint64(s))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(agentIndex))
+	binary.LittleEndian.PutUint64(buf[16:], atomic.AddUint64(&workerSeq, 1))
+	return rand.New(rand.NewSource(int64(murmur3.Sum64(buf[:]))))
+}
+
+// workerQuota returns how many of count operations worker i of n runs. With -seed
+// each worker runs a fixed share, so that the same documents and queries are
+// generated in every run; otherwise workers take operations until count runs
+// out.
+func workerQuota(count uint64, i, n int) uint64 {
+	if *seed == 0 || count == 0 {
+		return math.MaxUint64
+	}
+	q := count / uint64(n)
+	if uint64(i) < count%uint64(n) {
+		q++
+	}
+	return q
+}
+
+// newID returns a random UUID drawn from rnd.
+func newID(rnd *rand.Rand) string {
+	id := make(uuid.UUID, 16)
+	rnd.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id.String()
+}
+
+func generateMurmur3(rnd *rand.Rand) []byte {
 	var bytesArray [16]byte
 
-	lpointer := unsafe.Pointer(&bytesArray[0])
-	hpointer := unsafe.Pointer(&bytesArray[8])
-	*(*int64)(lpointer) = time.Now().UnixNano()
+	lpointer := unsafe.Pointer(&bytesArray[0])
+	hpointer := unsafe.Pointer(&bytesArray[8])
+	*(*uint64)(lpointer) = rnd.Uint64()
+
+	hasher := murmur3.New128()
+	hasher.Write(bytesArray[0:8])
+	r1, r2 := hasher.Sum128()
+
+	*(*uint64)(lpointer) = r1
+	*(*uint64)(hpointer) = r2
+
+	return bytesArray[:]
+}
+
+// hexOrders lists, for each keyN, the order in which the four hex parts of a
+// record are joined.
+var hexOrders = [20][4]int{
+	{0, 1, 2, 3}, {0, 1, 3, 2}, {0, 2, 1, 3}, {0, 2, 3, 1}, {0, 3, 1, 2},
+	{0, 3, 2, 1}, {1, 0, 2, 3}, {1, 0, 3, 2}, {1, 2, 0, 3}, {1, 2, 3, 0},
+	{1, 3, 2, 1}, {1, 3, 1, 2}, {2, 0, 1, 3}, {2, 0, 3, 1}, {2, 1, 0, 3},
+	{2, 1, 3, 0}, {2, 3, 0, 1}, {2, 3, 1, 0}, {3, 0, 1, 2}, {3, 0, 2, 1},
+}
+
+// permuteHexes returns the 20 keys of the record made of the hex parts.
+func permuteHexes(hexes [4]string) [20]string {
+	var keys [20]string
+	for i, order := range hexOrders {
+		keys[i] = hexes[order[0]] + hexes[order[1]] + hexes[order[2]] + hexes[order[3]]
+	}
+	return keys
+}
+
+func generateRandomHexes(rnd *rand.Rand) [20]string {
+	var hexes [4]string
+	for i := range hexes {
+		hexes[i] = hex.EncodeToString(generateMurmur3(rnd))
+	}
+	return permuteHexes(hexes)
+}
+
+// verifyDoc checks that doc, returned by query, has every queried value and,
+// without -schema, that its 20 keys are the permutations of the hex parts of
+// its key0.
+func verifyDoc(query, doc Doc) error {
+	for path, value := range query {
+		// compare the value as it went through JSON, like the one of doc
+		var expected interface{}
+		body, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(body, &expected)
+		}
+		if err != nil {
+			return err
+		}
+		if actual := lookup(doc, path); !reflect.DeepEqual(actual, expected) {
+			return fmt.Errorf("%s is %v, queried %v", path, actual, expected)
+		}
+	}
+	if schema != nil {
+		return nil
+	}
+	key0, _ := doc["key0"].(string)
+	if len(key0) != 128 {
+		return fmt.Errorf("key0 %q is not made of 4 hex parts", key0)
+	}
+	hexes := [4]string{key0[0:32], key0[32:64], key0[64:96], key0[96:128]}
+	for i, key := range permuteHexes(hexes) {
+		name := "key" + strconv.Itoa(i)
+		if doc[name] != key {
+			return fmt.Errorf("%s is %q, expected %q from key0", name, doc[name], key)
+		}
+	}
+	return nil
+}
+
+func write(client *http.Client, wg *sync.WaitGroup, rnd *rand.Rand, quota uint64, stats *Stats) {
+	var t uint64
+	count := *writeCount
+	doc := Doc{}
+	for done := uint64(0); done < quota; done++ {
+		if t = atomic.AddUint64(&totalWrite, 1); (count > 0 && t > count) || phase.Over() {
+			break
+		}
+
+		if writeOne(client, rnd, doc, stats, -1) != "" && t%(*frequency) == 0 {
+			logThroughput("POST", t)
+		}
+	}
+	wg.Done()
+}
+
+// setReadMode sets the read mode of the query req to -read-mode, if any.
+func setReadMode(req *http.Request) {
+	if *readMode != "" {
+		req.Header.Set("X-Mongo-Read-Mode", *readMode)
+	}
+}
+
+// setSession pins req to the Mongo session of the API server, unless session
+// is negative.
+func setSession(req *http.Request, session int) {
+	if session >= 0 {
+		req.Header.Set("X-Mongo-Session", strconv.Itoa(session))
+	}
+}
+
+// writeOne inserts one generated document through the API and returns the
+// key of its record, empty if it failed. Without -schema, doc is reused
+// between calls to save allocations.
+func writeOne(client *http.Client, rnd *rand.Rand, doc Doc, stats *Stats, session int) string {
+	id := newID(rnd)
+	hexes := generateRandomHexes(rnd)
+	if schema != nil {
+		doc = schema.Generate(hexes[0])
+	}
+	doc["_id"] = id
+
+	if schema == nil {
+		doc["key0"] = hexes[0]
+		doc["key1"] = hexes[1]
+		doc["key2"] = hexes[2]
+		doc["key3"] = hexes[3]
+		doc["key4"] = hexes[4]
+		doc["key5"] = hexes[5]
+		doc["key6"] = hexes[6]
+		doc["key7"] = hexes[7]
+		doc["key8"] = hexes[8]
+		doc["key9"] = hexes[9]
+		doc["key10"] = hexes[10]
+		doc["key11"] = hexes[11]
+		doc["key12"] = hexes[12]
+		doc["key13"] = hexes[13]
+		doc["key14"] = hexes[14]
+		doc["key15"] = hexes[15]
+		doc["key16"] = hexes[16]
+		doc["key17"] = hexes[17]
+		doc["key18"] = hexes[18]
+		doc["key19"] = hexes[19]
+	}
+
+	body, err := json.Marshal(&doc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", *url, bytes.NewReader(body))
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	req.Header["Content-Type"] = []string{"application/json"}
+	setSession(req, session)
+
+	start := pacer.Wait()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println(err)
+		stats.RecordError(start, 0)
+		return ""
+	}
+	resp.Body.Close()
+	stats.Record(start)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Println("POST Error", resp.StatusCode)
+		stats.RecordError(start, resp.StatusCode)
+		return ""
+	}
+
+	record := map[string]interface{}{"key0": hexes[0]}
+	if schema != nil {
+		record = schema.Record(doc)
+	}
+	line, err := json.Marshal(record)
+	if err == nil {
+		err = recorder.Record(line)
+	}
+	if err != nil {
+		log.Println("Record sample failed", err)
+	}
+	if recentKeys != nil {
+		recentKeys.Add(rnd, string(line))
+	}
+	return hexes[0]
+}
+
+// Schema describes the generated documents, which are 20 keys of 128 hex
+// characters without one. The document of a record is generated from its
+// key, so that queries and checks can regenerate it from the sample file.
+// The other programs reading -schema copy its code.
+type Schema struct {
+	Fields []*Field `yaml:"fields"`
+	// indexes are the paths of the indexed fields, fields their Field.
+	indexes []string
+	fields  map[string]*Field
+	// source is the content of the schema file.
+	source string
+}
+
+// Field describes a generated field, or Count fields named Name0 to
+// Name<Count-1>. Min and Max bound the length of a string, the value of an
+// int, the number of items of an array and the seconds after 2020-01-01 of a
+// date. Queries pick indexed fields, so they should be selective enough for
+// -miss-ratio.
+type Field struct {
+	Name  string `yaml:"name"`
+	Type  string `yaml:"type"`
+	Count int    `yaml:"count"`
+	Min   int64  `yaml:"min"`
+	Max   int64  `yaml:"max"`
+	Index bool   `yaml:"index"`
+	// Fields are the fields of a nested field.
+	Fields []*Field `yaml:"fields"`
+	// Items describes the items of an array field.
+	Items *Field `yaml:"items"`
+}
+
+var dateBase = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func loadSchema(path string) *Schema {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var schema Schema
+	err = yaml.Unmarshal(body, &schema)
+	if err != nil {
+		log.Fatalf("Parse schema %s failed: %s\n", path, err)
+	}
+	if len(schema.Fields) == 0 {
+		log.Fatalf("No field in schema %s\n", path)
+	}
+	for _, f := range schema.Fields {
+		if err = f.check(); err != nil {
+			log.Fatalf("Invalid schema %s: %s\n", path, err)
+		}
+	}
+	schema.source = string(body)
+	schema.fields = make(map[string]*Field)
+	schema.addIndexes("", schema.Fields)
+	if len(schema.indexes) == 0 {
+		log.Fatalf("No indexed field to query in schema %s\n", path)
+	}
+	return &schema
+}
+
+// check validates f and fills in the default bounds of its type.
+func (f *Field) check() error {
+	if f.Name == "" {
+		return fmt.Errorf("field without name")
+	}
+	if f.Count < 0 || f.Min < 0 || f.Max < f.Min {
+		return fmt.Errorf("invalid count or bounds of field %s", f.Name)
+	}
+	defaults := func(min, max int64) {
+		if f.Min == 0 && f.Max == 0 {
+			f.Min, f.Max = min, max
+		}
+	}
+	switch f.Type {
+	case "string":
+		defaults(32, 32)
+	case "int":
+		defaults(0, math.MaxInt32)
+	case "date":
+		defaults(0, 365*24*3600)
+	case "nested":
+		if len(f.Fields) == 0 {
+			return fmt.Errorf("nested field %s without fields", f.Name)
+		}
+		for _, child := range f.Fields {
+			if err := child.check(); err != nil {
+				return err
+			}
+		}
+	case "array":
+		if f.Items == nil {
+			return fmt.Errorf("array field %s without items", f.Name)
+		}
+		if f.Items.Name == "" {
+			f.Items.Name = f.Name
+		}
+		defaults(1, 5)
+		return f.Items.check()
+	default:
+		return fmt.Errorf("unknown type %q of field %s", f.Type, f.Name)
+	}
+	return nil
+}
+
+func (f *Field) names() []string {
+	if f.Count == 0 {
+		return []string{f.Name}
+	}
+	names := make([]string, f.Count)
+	for i := range names {
+		names[i] = f.Name + strconv.Itoa(i)
+	}
+	return names
+}
+
+// addIndexes adds the indexed fields among fields to s, the paths of nested
+// ones joined by dots.
+func (s *Schema) addIndexes(prefix string, fields []*Field) {
+	for _, f := range fields {
+		for _, name := range f.names() {
+			if f.Index {
+				s.indexes = append(s.indexes, prefix+name)
+				s.fields[prefix+name] = f
+			}
+			if f.Type == "nested" {
+				s.addIndexes(prefix+name+".", f.Fields)
+			}
+		}
+	}
+}
+
+// Generate returns the document of the record key, always the same one.
+func (s *Schema) Generate(key string) map[string]interface{} {
+	rnd := rand.New(rand.NewSource(int64(murmur3.Sum64([]byte(key)))))
+	return generateFields(rnd, s.Fields)
+}
+
+func generateFields(rnd *rand.Rand, fields []*Field) map[string]interface{} {
+	doc := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		for _, name := range f.names() {
+			doc[name] = f.generate(rnd)
+		}
+	}
+	return doc
+}
+
+func (f *Field) generate(rnd *rand.Rand) interface{} {
+	n := f.Min + rnd.Int63n(f.Max-f.Min+1)
+	switch f.Type {
+	case "string":
+		b := make([]byte, (n+1)/2)
+		rnd.Read(b)
+		return hex.EncodeToString(b)[:n]
+	case "int":
+		return n
+	case "date":
+		return dateBase.Add(time.Duration(n) * time.Second)
+	case "nested":
+		return generateFields(rnd, f.Fields)
+	case "array":
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = f.Items.generate(rnd)
+		}
+		return items
+	}
+	return nil
+}
+
+// MissRecord returns a sample record no generated document matches, each of
+// its values being out of the range of its field.
+func (s *Schema) MissRecord(rnd *rand.Rand) map[string]interface{} {
+	record := make(map[string]interface{}, len(s.indexes))
+	for _, path := range s.indexes {
+		record[path] = s.fields[path].missing(rnd)
+	}
+	return record
+}
+
+// missing returns a value f never generates: a string with a non-hex
+// character, an int above Max or a date before dateBase.
+func (f *Field) missing(rnd *rand.Rand) interface{} {
+	switch f.Type {
+	case "string":
+		value := f.generate(rnd).(string)
+		if value == "" {
+			return "x"
+		}
+		return "x" + value[1:]
+	case "int":
+		if f.Max == math.MaxInt64 {
+			return f.Min - 1
+		}
+		return f.Max + 1
+	case "date":
+		return dateBase.Add(-time.Duration(1+rnd.Int63n(f.Max-f.Min+1)) * time.Second)
+	case "nested":
+		doc := make(map[string]interface{}, len(f.Fields))
+		for _, sub := range f.Fields {
+			for _, name := range sub.names() {
+				doc[name] = sub.missing(rnd)
+			}
+		}
+		return doc
+	case "array":
+		return []interface{}{f.Items.missing(rnd)}
+	}
+	return nil
+}
+
+// Record returns the sample record of doc, the values of its indexed fields.
+func (s *Schema) Record(doc map[string]interface{}) map[string]interface{} {
+	record := make(map[string]interface{}, len(s.indexes))
+	for _, path := range s.indexes {
+		record[path] = lookup(doc, path)
+	}
+	return record
+}
+
+// Query returns the condition of a query for minKeys to maxKeys indexed
+// fields of record.
+func (s *Schema) Query(rnd *rand.Rand, record map[string]interface{}, minKeys, maxKeys int) map[string]interface{} {
+	keyCount := minKeys + rnd.Intn(maxKeys-minKeys+1)
+	query := make(map[string]interface{}, keyCount)
+	for i := 0; i < keyCount; i++ {
+		path := s.indexes[rnd.Intn(len(s.indexes))]
+		query[path] = s.typed(path, record[path])
+	}
+	return query
+}
+
+// typed converts a value of path decoded from JSON back to the type of its
+// field.
+func (s *Schema) typed(path string, value interface{}) interface{} {
+	switch s.fields[path].Type {
+	case "int":
+		if f, ok := value.(float64); ok {
+			return int64(f)
+		}
+	case "date":
+		if str, ok := value.(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, str); err == nil {
+				return t
+			}
+		}
+	}
+	return value
+}
+
+// recordSize returns the size of the sample records of s, which fits the
+// JSON object of the indexed fields and a newline.
+func (s *Schema) recordSize() int64 {
+	size := int64(2)
+	for _, path := range s.indexes {
+		size += int64(len(path)+4) + s.fields[path].maxJSON()
+	}
+	return size + 1
+}
+
+// maxJSON returns the max length of the JSON encoding of a value of f.
+func (f *Field) maxJSON() int64 {
+	switch f.Type {
+	case "string":
+		return f.Max + 2
+	case "int":
+		return 20
+	case "date":
+		return int64(len(`"2006-01-02T15:04:05.999999999Z07:00"`))
+	case "nested":
+		size := int64(2)
+		for _, child := range f.Fields {
+			for _, name := range child.names() {
+				size += int64(len(name)+4) + child.maxJSON()
+			}
+		}
+		return size
+	case "array":
+		return 2 + f.Max*(f.Items.maxJSON()+1)
+	}
+	return 0
+}
+
+// lookup returns the value at the dotted path of doc, nil if there is none.
+func lookup(doc map[string]interface{}, path string) interface{} {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		switch m := value.(type) {
+		case map[string]interface{}:
+			value = m[name]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+const (
+	sampleFormat  = "poc-sample"
+	sampleVersion = 1
+	// defaultRecordSize fits {"key0":"<128 hex characters>"} and a newline.
+	defaultRecordSize = 141
+)
+
+// SampleHeader is the first line of a sample file, a JSON object padded with
+// spaces to HeaderSize bytes. Count records of RecordSize bytes follow it,
+// each the JSON object of the Fields of a document padded with spaces and
+// ended by a newline. mongo-benchmark.go and api-benchmark-log-prepare.go
+// copy the code of the format, which must stay the same.
+type SampleHeader struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	HeaderSize int64  `json:"header_size"`
+	RecordSize int64  `json:"record_size"`
+	Count      int64  `json:"count"`
+	Seed       int64  `json:"seed"`
+	// Schema is the schema file of the documents, empty for 20 hex keys.
+	Schema string   `json:"schema"`
+	Fields []string `json:"fields"`
+	// Partitions is the number of databases and collections the documents
+	// are spread over, see -dbs and -colls of mongo-benchmark.
+	Partitions int `json:"partitions"`
+}
+
+// newSampleHeader returns the header of a sample file of the documents of
+// schema, nil for 20 hex keys.
+func newSampleHeader(schema *Schema, seed int64) SampleHeader {
+	header := SampleHeader{
+		Format:     sampleFormat,
+		Version:    sampleVersion,
+		RecordSize: defaultRecordSize,
+		Seed:       seed,
+		Fields:     []string{"key0"},
+		Partitions: 1,
+	}
+	if schema != nil {
+		header.RecordSize = schema.recordSize()
+		header.Schema = schema.source
+		header.Fields = schema.indexes
+	}
+	return header
+}
+
+func (h *SampleHeader) encode() ([]byte, error) {
+	line, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(line)) >= h.HeaderSize {
+		return nil, fmt.Errorf("sample header of %d bytes doesn't fit in %d", len(line), h.HeaderSize)
+	}
+	buf := bytes.Repeat([]byte{' '}, int(h.HeaderSize))
+	copy(buf, line)
+	buf[len(buf)-1] = '\n'
+	return buf, nil
+}
+
+// readSampleHeader validates the header of a sample file of size bytes and
+// returns it with the number of complete records.
+func readSampleHeader(r io.ReaderAt, size int64) (*SampleHeader, int64, error) {
+	buf := make([]byte, 1<<20)
+	if size < int64(len(buf)) {
+		buf = buf[:size]
+	}
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	end := bytes.IndexByte(buf[:n], '\n')
+	var header SampleHeader
+	if end < 0 || json.Unmarshal(buf[:end], &header) != nil || header.Format != sampleFormat {
+		return nil, 0, fmt.Errorf("not a sample file")
+	}
+	if header.Version != sampleVersion {
+		return nil, 0, fmt.Errorf("unsupported sample file version %d", header.Version)
+	}
+	if header.HeaderSize != int64(end+1) || header.RecordSize <= 0 || len(header.Fields) == 0 {
+		return nil, 0, fmt.Errorf("invalid sample file header")
+	}
+	if header.Partitions == 0 {
+		header.Partitions = 1
+	}
+
+	records := (size - header.HeaderSize) / header.RecordSize
+	if partial := (size - header.HeaderSize) % header.RecordSize; partial != 0 {
+		log.Printf("Ignoring a partial record of %d bytes at the end of the sample file\n", partial)
+	}
+	if records < header.Count {
+		return nil, 0, fmt.Errorf("sample file has %d records, its header %d", records, header.Count)
+	}
+	if records > header.Count {
+		log.Printf("Sample file has %d records more than its header, it wasn't closed\n", records-header.Count)
+	}
+	return &header, records, nil
+}
+
+// SampleWriter appends the records of written documents to a sample file.
+type SampleWriter struct {
+	lock   sync.Mutex
+	file   *os.File
+	header SampleHeader
+}
+
+// OpenSampleWriter opens the sample file at path to append records of the
+// documents described by header, creating it if needed. A partial record at
+// its end is dropped. Unless the run only reads the file, its seed must be the
+// one of the records already in it.
+func OpenSampleWriter(path string, header SampleHeader, readOnly bool) (*SampleWriter, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		// leave room for the count to grow
+		line, _ := json.Marshal(&header)
+		header.HeaderSize = (int64(len(line))/512 + 1) * 512
+	} else {
+		existing, records, err := readSampleHeader(file, info.Size())
+		if err == nil && (existing.Schema != header.Schema || existing.RecordSize != header.RecordSize) {
+			err = fmt.Errorf("sample file of another schema or record size")
+		}
+		if err == nil && !readOnly && existing.Seed != header.Seed {
+			err = fmt.Errorf("sample file of seed %d, not %d", existing.Seed, header.Seed)
+		}
+		if err == nil && existing.Partitions != header.Partitions {
+			err = fmt.Errorf("sample file of %d partitions, not %d", existing.Partitions, header.Partitions)
+		}
+		if err == nil {
+			existing.Count = records
+			err = file.Truncate(existing.HeaderSize + records*existing.RecordSize)
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		header = *existing
+	}
+
+	w := &SampleWriter{file: file, header: header}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// pad turns the JSON object line into a record.
+func (w *SampleWriter) pad(line []byte) ([]byte, error) {
+	if int64(len(line)) >= w.header.RecordSize {
+		return nil, fmt.Errorf("sample record of %d bytes doesn't fit in %d", len(line), w.header.RecordSize)
+	}
+	buf := bytes.Repeat([]byte{' '}, int(w.header.RecordSize))
+	copy(buf, line)
+	buf[len(buf)-1] = '\n'
+	return buf, nil
+}
+
+// Write appends the padded records, and returns how many were written. The
+// records of a short write are counted, and the next ones overwrite the
+// partial one.
+func (w *SampleWriter) Write(records []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n, err := w.file.WriteAt(records, w.header.HeaderSize+w.header.Count*w.header.RecordSize)
+	written := int64(n) / w.header.RecordSize
+	w.header.Count += written
+	return int(written), err
+}
+
+// Flush updates the count of records in the header.
+func (w *SampleWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	buf, err := w.header.encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.file.WriteAt(buf, 0)
+	return err
+}
+
+func (w *SampleWriter) Close() error {
+	err := w.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// SampleRecorder appends the records of all the writers to a sample file from
+// a single goroutine, batch records per write. Every flush interval the
+// header is updated and, with the "flush" sync policy, the file synced. The
+// first write error stops the recording, it is logged and returned to the
+// writers, and the records not written are counted as dropped.
+type SampleRecorder struct {
+	writer   *SampleWriter
+	records  chan []byte
+	flushes  chan chan error
+	done     chan error
+	policy   string
+	recorded uint64
+	written  uint64
+	dropped  uint64
+	lock     sync.Mutex
+	err      error
+	// closing is held by the senders on records, and by Close to close it
+	closing sync.RWMutex
+	closed  bool
+}
+
+func NewSampleRecorder(writer *SampleWriter, batch int, interval time.Duration, policy string) *SampleRecorder {
+	switch policy {
+	case "none", "flush", "close":
+	default:
+		log.Fatalf("Unknown sample sync policy %s\n", policy)
+	}
+	if interval <= 0 {
+		log.Fatalf("Sample flush interval must be positive, not %v\n", interval)
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	r := &SampleRecorder{
+		writer:  writer,
+		records: make(chan []byte, batch*4),
+		flushes: make(chan chan error),
+		done:    make(chan error),
+		policy:  policy,
+	}
+	go r.loop(batch, interval)
+	return r
+}
+
+var errRecorderClosed = fmt.Errorf("sample recorder closed")
+
+// Record queues the record of the JSON object line.
+func (r *SampleRecorder) Record(line []byte) error {
+	record, err := r.writer.pad(line)
+	if err != nil {
+		return err
+	}
+	r.closing.RLock()
+	defer r.closing.RUnlock()
+	if r.closed {
+		return errRecorderClosed
+	}
+	atomic.AddUint64(&r.recorded, 1)
+	if err := r.Err(); err != nil {
+		atomic.AddUint64(&r.dropped, 1)
+		return err
+	}
+	r.records <- record
+	return nil
+}
+
+func (r *SampleRecorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *SampleRecorder) fail(err error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err == nil && err != nil {
+		log.Println("Write sample file failed, dropping the next samples", err)
+		r.err = err
+	}
+	return r.err
+}
+
+// Flush writes the records queued so far and updates the header.
+func (r *SampleRecorder) Flush() error {
+	r.closing.RLock()
+	defer r.closing.RUnlock()
+	if r.closed {
+		return errRecorderClosed
+	}
+	reply := make(chan error)
+	r.flushes <- reply
+	return <-reply
+}
+
+// Close writes the queued records and closes the sample file. The records
+// recorded after it are refused.
+func (r *SampleRecorder) Close() error {
+	r.closing.Lock()
+	if r.closed {
+		r.closing.Unlock()
+		return errRecorderClosed
+	}
+	r.closed = true
+	close(r.records)
+	r.closing.Unlock()
+
+	err := <-r.done
+	if r.policy != "none" {
+		err = r.fail(r.writer.file.Sync())
+	}
+	if cerr := r.writer.Close(); err == nil {
+		err = cerr
+	}
+	dropped := atomic.LoadUint64(&r.dropped)
+	log.Printf("Samples recorded=%d written=%d dropped=%d\n", atomic.LoadUint64(&r.recorded), atomic.LoadUint64(&r.written), dropped)
+	if err != nil && dropped > 0 {
+		err = fmt.Errorf("%s, %d samples dropped", err, dropped)
+	}
+	return err
+}
+
+func (r *SampleRecorder) loop(batch int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := make([]byte, 0, batch*int(r.writer.header.RecordSize))
+	write := func() {
+		if len(pending) == 0 {
+			return
+		}
+		n := 0
+		if r.Err() == nil {
+			var err error
+			n, err = r.writer.Write(pending)
+			r.fail(err)
+		}
+		atomic.AddUint64(&r.written, uint64(n))
+		atomic.AddUint64(&r.dropped, uint64(int64(len(pending))/r.writer.header.RecordSize-int64(n)))
+		pending = pending[:0]
+	}
+	add := func(record []byte) {
+		pending = append(pending, record...)
+		if len(pending) >= cap(pending) {
+			write()
+		}
+	}
+	flush := func() error {
+		write()
+		if r.Err() != nil {
+			return r.Err()
+		}
+		err := r.writer.Flush()
+		if err == nil && r.policy == "flush" {
+			err = r.writer.file.Sync()
+		}
+		return r.fail(err)
+	}
+
+	for {
+		select {
+		case record, ok := <-r.records:
+			if !ok {
+				r.done <- flush()
+				return
+			}
+			add(record)
+		case <-ticker.C:
+			flush()
+		case reply := <-r.flushes:
+			// the records queued before the flush are part of it
+			for n := len(r.records); n > 0; n-- {
+				add(<-r.records)
+			}
+			reply <- flush()
+		}
+	}
+}
+
+// SampleReader reads the records of a sample file.
+type SampleReader struct {
+	Header SampleHeader
+	r      io.ReaderAt
+	count  int
+}
+
+func NewSampleReader(r io.ReaderAt, size int64) (*SampleReader, error) {
+	header, records, err := readSampleHeader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &SampleReader{Header: *header, r: r, count: int(records)}, nil
+}
+
+func (s *SampleReader) Len() int {
+	return s.count
+}
+
+// Record returns the JSON object of record i.
+func (s *SampleReader) Record(i int) ([]byte, error) {
+	buf := make([]byte, s.Header.RecordSize)
+	n, err := s.r.ReadAt(buf, s.Header.HeaderSize+int64(i)*s.Header.RecordSize)
+	if n < len(buf) {
+		return nil, fmt.Errorf("read sample record %d: %v", i, err)
+	}
+	if buf[len(buf)-1] != '\n' {
+		return nil, fmt.Errorf("corrupt sample record %d", i)
+	}
+	return bytes.TrimRight(buf, " \n"), nil
+}
+
+// KeyPool remembers the sample records of documents written during the mixed
+// phase, so that queries of the same run can look them up. Once full, new keys replace
+// random old ones.
+type KeyPool struct {
+	lock sync.RWMutex
+	keys []string
+	max  int
+}
+
+func NewKeyPool(max int) *KeyPool {
+	return &KeyPool{max: max}
+}
+
+// Add adds key, replacing an old one drawn from rnd once the pool is full.
+func (p *KeyPool) Add(rnd *rand.Rand, key string) {
+	if p.max <= 0 {
+		return
+	}
+	p.lock.Lock()
+	if len(p.keys) < p.max {
+		p.keys = append(p.keys, key)
+	} else {
+		p.keys[rnd.Intn(p.max)] = key
+	}
+	p.lock.Unlock()
+}
+
+func (p *KeyPool) Len() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.keys)
+}
+
+func (p *KeyPool) Get(i int) string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.keys[i]
+}
+
+// Chooser picks which of n sample records is queried next.
+type Chooser interface {
+	Next(rnd *rand.Rand, n int) int
+}
+
+// NewChooser returns the Chooser of the -distribution flag.
+func NewChooser(name string) Chooser {
+	if (name == "zipfian" || name == "latest") && (*zipfTheta <= 0 || *zipfTheta >= 1) {
+		log.Fatalf("-zipf-theta must be in (0, 1)\n")
+	}
+	switch name {
+	case "uniform":
+		return uniformChooser{}
+	case "zipfian":
+		return &scrambledChooser{zipf: &ZipfianChooser{theta: *zipfTheta}}
+	case "latest":
+		return &latestChooser{zipf: &ZipfianChooser{theta: *zipfTheta}}
+	case "hotspot":
+		if *hotFraction <= 0 || *hotFraction > 1 || *hotOps < 0 || *hotOps > 1 {
+			log.Fatalf("-hot-fraction must be in (0, 1] and -hot-ops in [0, 1]\n")
+		}
+		return &hotspotChooser{fraction: *hotFraction, ops: *hotOps}
+	}
+	log.Fatalf("Unknown distribution %s\n", name)
+	return nil
+}
+
+type uniformChooser struct{}
+
+func (uniformChooser) Next(rnd *rand.Rand, n int) int {
+	return rnd.Intn(n)
+}
+
+// ZipfianChooser picks rank 0 most often, following the zipfian generator of
+// YCSB ("Quickly Generating Billion-Record Synthetic Databases", Gray et al.).
+// The zeta constant is extended incrementally as n grows.
+type ZipfianChooser struct {
+	lock  sync.Mutex
+	theta float64
+	n     int
+	zetan float64
+	eta   float64
+}
+
+func zeta(from, to int, theta, sum float64) float64 {
+	for i := from; i < to; i++ {
+		sum += 1 / math.Pow(float64(i+1), theta)
+	}
+	return sum
+}
+
+func (z *ZipfianChooser) Next(rnd *rand.Rand, n int) int {
+	z.lock.Lock()
+	if n != z.n {
+		if n > z.n {
+			z.zetan = zeta(z.n, n, z.theta, z.zetan)
+		} else {
+			z.zetan = zeta(0, n, z.theta, 0)
+		}
+		z.n = n
+		zeta2 := zeta(0, 2, z.theta, 0)
+		z.eta = (1 - math.Pow(2/float64(n), 1-z.theta)) / (1 - zeta2/z.zetan)
+	}
+	zetan, eta := z.zetan, z.eta
+	z.lock.Unlock()
+
+	u := rnd.Float64()
+	uz := u * zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) && n > 1 {
+		return 1
+	}
+	rank := int(float64(n) * math.Pow(eta*u-eta+1, 1/(1-z.theta)))
+	if rank >= n {
+		rank = n - 1
+	}
+	return rank
+}
+
+// scrambledChooser spreads the popular ranks of a zipfian distribution over
+// the whole sample file instead of its first records.
+type scrambledChooser struct {
+	zipf *ZipfianChooser
+}
+
+func (c *scrambledChooser) Next(rnd *rand.Rand, n int) int {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(c.zipf.Next(rnd, n)))
+	hasher := fnv.New64a()
+	hasher.Write(buf[:])
+	return int(hasher.Sum64() % uint64(n))
+}
+
+// latestChooser prefers the records written last.
+type latestChooser struct {
+	zipf *ZipfianChooser
+}
+
+func (c *latestChooser) Next(rnd *rand.Rand, n int) int {
+	return n - 1 - c.zipf.Next(rnd, n)
+}
+
+// hotspotChooser sends ops of the queries to the first fraction of records
+// and the rest to the other records.
+type hotspotChooser struct {
+	fraction float64
+	ops      float64
+}
+
+func (c *hotspotChooser) Next(rnd *rand.Rand, n int) int {
+	hot := int(float64(n) * c.fraction)
+	if hot < 1 {
+		hot = 1
+	}
+	if hot >= n || rnd.Float64() < c.ops {
+		return rnd.Intn(hot)
+	}
+	return hot + rnd.Intn(n-hot)
+}
+
+// sampleCount returns how many records getQueryBody can pick from.
+func sampleCount() int {
+	total := 0
+	if samples != nil {
+		total = samples.Len()
+	}
+	if recentKeys != nil {
+		total += recentKeys.Len()
+	}
+	return total
+}
+
+// pickSample returns a random sample record, either from the sample file or
+// from recentKeys.
+func pickSample(rnd *rand.Rand) map[string]interface{} {
+	total := sampleCount()
+	if total == 0 {
+		log.Fatalf("No data in %s to be read", *samplePath)
+	}
+	randPos := chooser.Next(rnd, total)
+	fileTotal := 0
+	if samples != nil {
+		fileTotal = samples.Len()
+	}
+
+	var line []byte
+	if randPos >= fileTotal {
+		line = []byte(recentKeys.Get(randPos - fileTotal))
+	} else {
+		var err error
+		line, err = samples.Record(randPos)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var record map[string]interface{}
+	err := json.Unmarshal(line, &record)
+	if err != nil {
+		log.Fatalf("Parse sample record %s failed: %s\n", line, err)
+	}
+	return record
+}
+
+// openSamples opens the sample file for queries, once per run, with the
+// records written so far.
+func openSamples() {
+	if samples != nil {
+		return
+	}
+	err := recorder.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sampleMemoryFile, err = mmap.Open(*samplePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	samples, err = NewSampleReader(sampleMemoryFile, int64(sampleMemoryFile.Len()))
+	if err != nil {
+		log.Fatalf("%s: %s\n", *samplePath, err)
+	}
+}
+
+// missKey turns key0 of a record into the key0 of a record which can't
+// exist: every keyN is made of its 32 characters hex parts, and each of them
+// starts with 'x', which is not a hex digit.
+func missKey(key string) string {
+	b := []byte(key)
+	for i := 0; i < len(b); i += 32 {
+		b[i] = 'x'
+	}
+	return string(b)
+}
+
+// getQueryBody returns the condition of a query for a sample record, or for
+// a record which doesn't exist if miss is set.
+func getQueryBody(rnd *rand.Rand, miss bool) Doc {
+	if schema != nil {
+		var record map[string]interface{}
+		if miss {
+			record = schema.MissRecord(rnd)
+		} else {
+			record = pickSample(rnd)
+		}
+		return schema.Query(rnd, record, queryMinKeys, queryMaxKeys)
+	}
+
+	doc := Doc{}
+	key, _ := pickSample(rnd)["key0"].(string)
+	if len(key) != 128 {
+		log.Fatalf("Sample record without a key0 of 128 hex characters in %s\n", *samplePath)
+	}
+	if miss {
+		key = missKey(key)
+	}
+	keys := permuteHexes([4]string{key[0:32], key[32:64], key[64:96], key[96:128]})
+	keyCount := int32(queryMinKeys) + rnd.Int31n(int32(queryMaxKeys-queryMinKeys+1))
+	for i := int32(0); i < keyCount; i++ {
+		keyNum := rnd.Int31n(20)
+		doc["key"+strconv.Itoa(int(keyNum))] = keys[keyNum]
+	}
+	return doc
+}
+
+func query(client *http.Client, wg *sync.WaitGroup, rnd *rand.Rand, quota uint64, stats *Stats) {
+	var t uint64
+	count := *queryCount
+	for done := uint64(0); done < quota; done++ {
+		if t = atomic.AddUint64(&totalQuery, 1); (count > 0 && t > count) || phase.Over() {
+			break
+		}
+
+		if queryOne(client, rnd, stats) && t%(*frequency) == 0 {
+			logThroughput("GET", t)
+		}
+	}
+	wg.Done()
+}
+
+// queryOne sends one query, -miss-ratio of them for records which don't
+// exist, expecting 404 and recorded in the miss stats.
+func queryOne(client *http.Client, rnd *rand.Rand, stats *Stats) bool {
+	miss := *missRatio > 0 && rnd.Float64() < *missRatio
+	if miss {
+		stats = stats.MissStats()
+	}
+
+	query := getQueryBody(rnd, miss)
+	body, err := json.Marshal(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", *url, bytes.NewReader(body))
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	req.Header["Content-Type"] = []string{"application/json"}
+	setReadMode(req)
 
-	hasher := murmur3.New128()
-	hasher.Write(bytesArray[0:8])
-	r1, r2 := hasher.Sum128()
+	start := pacer.Wait()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println(err)
+		stats.RecordError(start, 0)
+		return false
+	}
+	var respBody []byte
+	if *verify {
+		respBody, err = ioutil.ReadAll(resp.Body)
+	} else {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	resp.Body.Close()
+	if err != nil {
+		log.Println(err)
+		stats.RecordError(start, 0)
+		return false
+	}
+	stats.Record(start)
 
-	*(*uint64)(lpointer) = r1
-	*(*uint64)(hpointer) = r2
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if miss {
+		ok = resp.StatusCode == http.StatusNotFound
+	}
+	if !ok {
+		log.Println("GET Error", resp.StatusCode)
+		stats.RecordError(start, resp.StatusCode)
+		return false
+	}
 
-	return bytesArray[:]
+	if *verify && !miss {
+		var doc Doc
+		err = json.Unmarshal(respBody, &doc)
+		if err == nil {
+			err = verifyDoc(query, doc)
+		}
+		if err != nil {
+			log.Printf("Invalid response to query %v: %s\n", query, err)
+			stats.RecordError(start, invalidResponse)
+			return false
+		}
+	}
+	return true
 }
 
-func generateRandomHexes() [20]string {
-	var bytes1 []byte = generateMurmur3()
-	var bytes2 []byte = generateMurmur3()
-	var bytes3 []byte = generateMurmur3()
-	var bytes4 []byte = generateMurmur3()
-	var hex1 string = hex.EncodeToString(bytes1)
-	var hex2 string = hex.EncodeToString(bytes2)
-	var hex3 string = hex.EncodeToString(bytes3)
-	var hex4 string = hex.EncodeToString(bytes4)
-	return [20]string{
-		strings.Join([]string{hex1, hex2, hex3, hex4}, ""),
-		strings.Join([]string{hex1, hex2, hex4, hex3}, ""),
-		strings.Join([]string{hex1, hex3, hex2, hex4}, ""),
-		strings.Join([]string{hex1, hex3, hex4, hex2}, ""),
-		strings.Join([]string{hex1, hex4, hex2, hex3}, ""),
-		strings.Join([]string{hex1, hex4, hex3, hex2}, ""),
-		strings.Join([]string{hex2, hex1, hex3, hex4}, ""),
-		strings.Join([]string{hex2, hex1, hex4, hex3}, ""),
-		strings.Join([]string{hex2, hex3, hex1, hex4}, ""),
-		strings.Join([]string{hex2, hex3, hex4, hex1}, ""),
-		strings.Join([]string{hex2, hex4, hex3, hex2}, ""),
-		strings.Join([]string{hex2, hex4, hex2, hex3}, ""),
-		strings.Join([]string{hex3, hex1, hex2, hex4}, ""),
-		strings.Join([]string{hex3, hex1, hex4, hex2}, ""),
-		strings.Join([]string{hex3, hex2, hex1, hex4}, ""),
-		strings.Join([]string{hex3, hex2, hex4, hex1}, ""),
-		strings.Join([]string{hex3, hex4, hex1, hex2}, ""),
-		strings.Join([]string{hex3, hex4, hex2, hex1}, ""),
-		strings.Join([]string{hex4, hex1, hex2, hex3}, ""),
-		strings.Join([]string{hex4, hex1, hex3, hex2}, ""),
-	}
-}
-
-func write(client *http.Client, wg *sync.WaitGroup) {
+// readYourWrites writes documents and queries each back by its key0 right
+// away. writeStats records the writes and staleStats, for the documents which
+// weren't visible at once, how long they stayed invisible.
+func readYourWrites(client *http.Client, wg *sync.WaitGroup, rnd *rand.Rand, quota uint64, worker int, writeStats, staleStats *Stats) {
+	writeSession, readSession := -1, -1
+	switch *rywSession {
+	case "same":
+		writeSession, readSession = worker, worker
+	case "other":
+		writeSession, readSession = worker, worker+1
+	}
+
 	var t uint64
-	count := *writeCount
+	count := *rywCount
 	doc := Doc{}
-	for {
-		if t = atomic.AddUint64(&totalWrite, 1); count > 0 && t > count {
+	for done := uint64(0); done < quota; done++ {
+		if t = atomic.AddUint64(&totalRYW, 1); (count > 0 && t > count) || phase.Over() {
 			break
 		}
 
-		doc["_id"] = uuid.New()
-
-		hexes := generateRandomHexes()
-		doc["key0"] = hexes[0]
-		doc["key1"] = hexes[1]
-		doc["key2"] = hexes[2]
-		doc["key3"] = hexes[3]
-		doc["key4"] = hexes[4]
-		doc["key5"] = hexes[5]
-		doc["key6"] = hexes[6]
-		doc["key7"] = hexes[7]
-		doc["key8"] = hexes[8]
-		doc["key9"] = hexes[9]
-		doc["key10"] = hexes[10]
-		doc["key11"] = hexes[11]
-		doc["key12"] = hexes[12]
-		doc["key13"] = hexes[13]
-		doc["key14"] = hexes[14]
-		doc["key15"] = hexes[15]
-		doc["key16"] = hexes[16]
-		doc["key17"] = hexes[17]
-		doc["key18"] = hexes[18]
-		doc["key19"] = hexes[19]
-
-		body, err := json.Marshal(&doc)
-		if err != nil {
-			log.Fatal(err)
+		key := writeOne(client, rnd, doc, writeStats, writeSession)
+		if key != "" && checkVisible(client, key, readSession, staleStats) && t%(*frequency) == 0 {
+			logThroughput("RYW", t)
 		}
+	}
+	wg.Done()
+}
+
+// checkVisible queries the document of key until it is visible or
+// -ryw-timeout passed since its write. The staleness recorded spans from the
+// end of the write to the end of the first query which found it.
+func checkVisible(client *http.Client, key string, session int, stats *Stats) bool {
+	query := Doc{"key0": key}
+	if schema != nil {
+		query = schema.Record(schema.Generate(key))
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		req, err := http.NewRequest("POST", *url, bytes.NewReader(body))
+	written := time.Now()
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", *url, bytes.NewReader(body))
 		if err != nil {
 			log.Println(err)
-			continue
+			return false
 		}
 		req.Header["Content-Type"] = []string{"application/json"}
+		setReadMode(req)
+		setSession(req, session)
 
 		resp, err := client.Do(req)
 		if err != nil {
 			log.Println(err)
-			continue
+			stats.RecordError(written, 0)
+			return false
 		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
 		resp.Body.Close()
 
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			log.Println("POST Error", resp.StatusCode)
-			continue
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			if attempt > 0 {
+				stats.Record(written)
+			}
+			return true
+		case resp.StatusCode != http.StatusNotFound:
+			log.Println("GET Error", resp.StatusCode)
+			stats.RecordError(written, resp.StatusCode)
+			return false
+		case time.Since(written) >= *rywTimeout:
+			log.Println("Document never visible", key)
+			stats.RecordError(written, http.StatusNotFound)
+			return false
 		}
+		time.Sleep(*rywPoll)
+	}
+}
 
-		sampleFile.WriteString(hexes[0])
+// mixed sends queries and writes from the same worker, readRatio of the
+// operations are queries. It only writes until something can be queried.
+func mixed(client *http.Client, wg *sync.WaitGroup, rnd *rand.Rand, quota uint64, count uint64, readRatio float64, writeStats, queryStats *Stats) {
+	var t uint64
+	doc := Doc{}
+	for done := uint64(0); done < quota; done++ {
+		if t = atomic.AddUint64(&totalMixed, 1); (count > 0 && t > count) || phase.Over() {
+			break
+		}
 
-		if t%(*frequency) == 0 {
-			log.Println("POST", t, float64(*frequency)/time.Since(last).Seconds())
-			last = time.Now()
+		var ok bool
+		if rnd.Float64() < readRatio && sampleCount() > 0 {
+			ok = queryOne(client, rnd, queryStats)
+		} else {
+			ok = writeOne(client, rnd, doc, writeStats, -1) != ""
+		}
+		if ok && t%(*frequency) == 0 {
+			logThroughput("MIXED", t)
 		}
 	}
 	wg.Done()
 }
 
-func getQueryBody() Doc {
-	doc := Doc{}
-	buf := make([]byte, 128)
-	total := int32(sampleMemoryFileLen >> 7)
-	if total == 0 {
-		log.Fatalf("No data in %s to be read", *samplePath)
-	}
-	randPos := rand.Int31n(total)
-	readLen, err := sampleMemoryFile.ReadAt(buf, int64(randPos)<<7)
+// Scenario is a multi-phase workload loaded from a YAML or JSON file by
+// -scenario. Phases run in order.
+type Scenario struct {
+	Phases []*PhaseConfig `yaml:"phases"`
+}
+
+// PhaseConfig describes one phase of a Scenario. Kind is one of load, ramp,
+// steady or spike, a ramp phase moves the rate from Rate to RateTo over its
+// duration. ReadRatio is the fraction of queries, so a load phase is 0.
+type PhaseConfig struct {
+	Name        string        `yaml:"name"`
+	Kind        string        `yaml:"kind"`
+	Concurrency int           `yaml:"concurrency"`
+	Rate        float64       `yaml:"rate"`
+	RateTo      float64       `yaml:"rate_to"`
+	Arrival     string        `yaml:"arrival"`
+	ReadRatio   float64       `yaml:"read_ratio"`
+	Count       uint64        `yaml:"count"`
+	Duration    time.Duration `yaml:"duration"`
+	Warmup      time.Duration `yaml:"warmup"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+	MinKeys     int           `yaml:"min_keys"`
+	MaxKeys     int           `yaml:"max_keys"`
+}
+
+func loadScenario(path string) *Scenario {
+	body, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if readLen != 128 {
-		log.Fatalf("Expect to read 128 bytes, but only %d bytes\n", readLen)
+	var scenario Scenario
+	err = yaml.Unmarshal(body, &scenario)
+	if err != nil {
+		log.Fatalf("Parse scenario %s failed: %s\n", path, err)
 	}
-	hex1 := string(buf[0:32])
-	hex2 := string(buf[32:64])
-	hex3 := string(buf[64:96])
-	hex4 := string(buf[96:128])
-	keyCount := rand.Int31n(5) + 1
-	for i := int32(0); i < keyCount; i++ {
-		keyNum := rand.Int31n(20)
-		switch keyNum {
-		case 0:
-			doc["key0"] = strings.Join([]string{hex1, hex2, hex3, hex4}, "")
-		case 1:
-			doc["key1"] = strings.Join([]string{hex1, hex2, hex4, hex3}, "")
-		case 2:
-			doc["key2"] = strings.Join([]string{hex1, hex3, hex2, hex4}, "")
-		case 3:
-			doc["key3"] = strings.Join([]string{hex1, hex3, hex4, hex2}, "")
-		case 4:
-			doc["key4"] = strings.Join([]string{hex1, hex4, hex2, hex3}, "")
-		case 5:
-			doc["key5"] = strings.Join([]string{hex1, hex4, hex3, hex2}, "")
-		case 6:
-			doc["key6"] = strings.Join([]string{hex2, hex1, hex3, hex4}, "")
-		case 7:
-			doc["key7"] = strings.Join([]string{hex2, hex1, hex4, hex3}, "")
-		case 8:
-			doc["key8"] = strings.Join([]string{hex2, hex3, hex1, hex4}, "")
-		case 9:
-			doc["key9"] = strings.Join([]string{hex2, hex3, hex4, hex1}, "")
-		case 10:
-			doc["key10"] = strings.Join([]string{hex2, hex4, hex3, hex2}, "")
-		case 11:
-			doc["key11"] = strings.Join([]string{hex2, hex4, hex2, hex3}, "")
-		case 12:
-			doc["key12"] = strings.Join([]string{hex3, hex1, hex2, hex4}, "")
-		case 13:
-			doc["key13"] = strings.Join([]string{hex3, hex1, hex4, hex2}, "")
-		case 14:
-			doc["key14"] = strings.Join([]string{hex3, hex2, hex1, hex4}, "")
-		case 15:
-			doc["key15"] = strings.Join([]string{hex3, hex2, hex4, hex1}, "")
-		case 16:
-			doc["key16"] = strings.Join([]string{hex3, hex4, hex1, hex2}, "")
-		case 17:
-			doc["key17"] = strings.Join([]string{hex3, hex4, hex2, hex1}, "")
-		case 18:
-			doc["key18"] = strings.Join([]string{hex4, hex1, hex2, hex3}, "")
-		case 19:
-			doc["key19"] = strings.Join([]string{hex4, hex1, hex3, hex2}, "")
+	if len(scenario.Phases) == 0 {
+		log.Fatalf("No phase in scenario %s\n", path)
+	}
+
+	for i, p := range scenario.Phases {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("phase%d", i)
+		}
+		switch p.Kind {
+		case "":
+			p.Kind = "steady"
+		case "load", "steady", "spike":
+		case "ramp":
+			if p.Duration <= 0 || p.RateTo <= 0 {
+				log.Fatalf("Ramp phase %s needs duration and rate_to\n", p.Name)
+			}
+		default:
+			log.Fatalf("Unknown kind %s of phase %s\n", p.Kind, p.Name)
+		}
+		if p.Count == 0 && p.Duration <= 0 {
+			log.Fatalf("Phase %s needs count or duration\n", p.Name)
+		}
+		if p.Concurrency <= 0 {
+			p.Concurrency = *NumberGoroutine
+		}
+		if p.Arrival == "" {
+			p.Arrival = *arrival
+		}
+		if p.MinKeys <= 0 {
+			p.MinKeys = 1
+		}
+		if p.MaxKeys <= 0 {
+			p.MaxKeys = 5
+		}
+		if p.MaxKeys < p.MinKeys {
+			p.MaxKeys = p.MinKeys
+		}
+		if p.MaxKeys > 20 {
+			log.Fatalf("Phase %s queries at most 20 keys\n", p.Name)
 		}
 	}
-	return doc
+	return &scenario
 }
 
-func query(client *http.Client, wg *sync.WaitGroup) {
-	var t uint64
-	count := *queryCount
-	for {
-		if t = atomic.AddUint64(&totalQuery, 1); count > 0 && t > count {
+func (p *PhaseConfig) pacer() *Pacer {
+	if p.Kind == "ramp" {
+		return NewRampPacer(p.Rate, p.RateTo, p.Duration, p.Arrival)
+	}
+	return NewPacer(p.Rate, p.Arrival)
+}
+
+// runScenario runs every phase of scenario with the mixed worker, so a phase
+// writes, queries or both depending on its read ratio.
+func runScenario(client *http.Client, scenario *Scenario) {
+	var wg sync.WaitGroup
+	for _, p := range scenario.Phases {
+		if stopped() {
+			break
+		}
+		log.Printf("Phase %s (%s): concurrency=%d rate=%v read_ratio=%v\n", p.Name, p.Kind, p.Concurrency, p.Rate, p.ReadRatio)
+		queryMinKeys, queryMaxKeys = p.MinKeys, p.MaxKeys
+		atomic.StoreUint64(&totalMixed, 0)
+
+		wg.Add(p.Concurrency)
+
+		writeSampler := StartSampler()
+		querySampler := StartSampler()
+		writeStats := make([]*Stats, p.Concurrency)
+		queryStats := make([]*Stats, p.Concurrency)
+		last = time.Now().UnixNano()
+		phase = NewPhase(p.Duration, p.Warmup, p.Cooldown)
+		pacer = p.pacer()
+		for i := 0; i < p.Concurrency; i++ {
+			writeStats[i] = NewStats()
+			writeStats[i].Sampler = writeSampler
+			queryStats[i] = NewStats()
+			queryStats[i].Sampler = querySampler
+			go mixed(client, &wg, newRand(), workerQuota(p.Count, i, p.Concurrency), p.Count, p.ReadRatio, writeStats[i], queryStats[i])
+		}
+		wg.Wait()
+		if p.ReadRatio < 1 {
+			report(p.Name, "POST", mergeStats(writeStats), writeSampler)
+		} else {
+			writeSampler.Stop()
+		}
+		if p.ReadRatio > 0 {
+			report(p.Name, "GET", mergeStats(queryStats), querySampler)
+		} else {
+			querySampler.Stop()
+		}
+	}
+}
+
+// saturate steps the rate or the concurrency up until the -slo latency or
+// -max-error-ratio is breached, then reports the highest throughput of the
+// steps within them. In linear mode the level moves continuously from one
+// step to the next instead of staying flat for the whole step.
+func saturate(client *http.Client) {
+	var wg sync.WaitGroup
+	best := &Saturation{Mode: *saturateMode}
+	level := *stepStart
+	for step := 0; step < *maxSteps && !stopped(); step++ {
+		name := fmt.Sprintf("step%d", step)
+		next := level + *stepSize
+		concurrency, workers := *NumberGoroutine, *NumberGoroutine
+
+		phase = NewPhase(*stepDuration, 0, 0)
+		switch *saturateMode {
+		case "rate":
+			if *rampMode == "linear" {
+				pacer = NewRampPacer(level, next, *stepDuration, *arrival)
+			} else {
+				pacer = NewPacer(level, *arrival)
+			}
+		case "concurrency":
+			concurrency, workers = int(level), int(level)
+			if *rampMode == "linear" {
+				workers = int(next)
+			}
+			pacer = NewPacer(*rate, *arrival)
+		}
+		log.Printf("Step %d: %s=%v\n", step, *saturateMode, level)
+		atomic.StoreUint64(&totalMixed, 0)
+
+		wg.Add(workers)
+
+		writeSampler := StartSampler()
+		querySampler := StartSampler()
+		writeStats := make([]*Stats, workers)
+		queryStats := make([]*Stats, workers)
+		last = time.Now().UnixNano()
+		for i := 0; i < workers; i++ {
+			writeStats[i] = NewStats()
+			writeStats[i].Sampler = writeSampler
+			queryStats[i] = NewStats()
+			queryStats[i].Sampler = querySampler
+
+			// workers beyond concurrency join evenly during a linear step
+			var delay time.Duration
+			if i >= concurrency {
+				delay = time.Duration(float64(*stepDuration) * float64(i-concurrency+1) / float64(workers-concurrency+1))
+			}
+			go func(i int, delay time.Duration, rnd *rand.Rand) {
+				time.Sleep(delay)
+				mixed(client, &wg, rnd, math.MaxUint64, 0, *readRatio, writeStats[i], queryStats[i])
+			}(i, delay, newRand())
+		}
+		wg.Wait()
+
+		elapsed := phase.Elapsed()
+		writes := mergeStats(writeStats)
+		queries := mergeStats(queryStats)
+		report(name, "POST", writes, writeSampler)
+		report(name, "GET", queries, querySampler)
+		if stopped() {
+			// a cut short step says nothing about its level
+			break
+		}
+
+		// writes, hits and misses are each counted once, not through Merge
+		// which keeps the misses apart
+		all := NewStats()
+		for _, s := range []*Stats{writes, queries, queries.Misses} {
+			if s == nil {
+				continue
+			}
+			all.Latency.Merge(s.Latency)
+			for code, n := range s.Errors {
+				all.Errors[code] += n
+			}
+		}
+		failed := uint64(0)
+		for _, n := range all.Errors {
+			failed += n
+		}
+		// the requests answered with an error status have a latency, those
+		// failed before any response only their Errors[0] count
+		total := uint64(all.Latency.TotalCount()) + all.Errors[0]
+		latency := time.Duration(all.Latency.ValueAtQuantile(*sloPercentile)) * time.Microsecond
+		if total == 0 || latency > *slo || float64(failed)/float64(total) > *maxErrorRatio {
+			log.Printf("Step %d breached: p%v=%v failed=%d/%d\n", step, *sloPercentile, latency, failed, total)
 			break
 		}
 
-		body, err := json.Marshal(getQueryBody())
+		throughput := float64(total-failed) / elapsed.Seconds()
+		if throughput > best.Throughput {
+			best.Level, best.Throughput = level, throughput
+		}
+		level = next
+	}
+	log.Printf("Max sustainable throughput %.1f/s at %s=%v\n", best.Throughput, best.Mode, best.Level)
+	result.Saturation = best
+}
+
+func ensureIndexes(coll *mgo.Collection) {
+	if schema != nil {
+		for _, path := range schema.indexes {
+			err := coll.EnsureIndexKey(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	for i := 0; i < 20; i++ {
+		err := coll.EnsureIndexKey("key" + strconv.Itoa(i))
 		if err != nil {
 			log.Fatal(err)
 		}
+	}
+}
 
-		req, err := http.NewRequest("GET", *url, bytes.NewReader(body))
+// localFlags are the flags describing the environment of one process, they
+// are not sent from the coordinator to agents.
+var localFlags = map[string]bool{
+	"agent":         true,
+	"agents":        true,
+	"agent-timeout": true,
+	"start-delay":   true,
+	"sample-path":   true,
+	"mongo":         true,
+	"d":             true,
+	"c":             true,
+	"result-json":   true,
+	"result-csv":    true,
+}
+
+// fileFlags are the flags naming a file, whose content the coordinator sends
+// so agents don't need a copy of it.
+var fileFlags = map[string]bool{
+	"scenario": true,
+	"schema":   true,
+}
+
+// RunRequest is sent by the coordinator to an agent to run a workload. Start
+// is the wall clock time all agents start at, so their clocks must be in sync.
+// Agent is the index of the agent, which keeps the workers of different agents
+// apart under -seed. Files holds the content of the fileFlags.
+type RunRequest struct {
+	Flags map[string]string `json:"flags"`
+	Files map[string]string `json:"files,omitempty"`
+	Start time.Time         `json:"start"`
+	Agent int               `json:"agent"`
+}
+
+// writeRunFiles writes the files of req to temporary files and points their
+// flags at them, and returns them to be removed after the run.
+func writeRunFiles(req *RunRequest) ([]string, error) {
+	var paths []string
+	for name, content := range req.Files {
+		if !fileFlags[name] {
+			return paths, fmt.Errorf("unknown file flag %s", name)
+		}
+		file, err := ioutil.TempFile("", "api-benchmark-"+name)
 		if err != nil {
-			log.Println(err)
-			continue
+			return paths, err
 		}
-		req.Header["Content-Type"] = []string{"application/json"}
+		paths = append(paths, file.Name())
+		_, err = file.WriteString(content)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return paths, err
+		}
+		flag.Set(name, file.Name())
+		setFlags[name] = true
+	}
+	return paths, nil
+}
 
-		resp, err := client.Do(req)
+// serveAgent runs the workload of every RunRequest posted to /run, one at a
+// time, and responds with its result document.
+func serveAgent(client *http.Client, coll *mgo.Collection) {
+	var lock sync.Mutex
+
+	http.HandleFunc("/run", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req RunRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Println("Parse Body Failed", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-		_, _ = io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
 
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			log.Println("GET Error", resp.StatusCode)
-			continue
+		lock.Lock()
+		defer lock.Unlock()
+
+		flag.VisitAll(func(f *flag.Flag) {
+			if !localFlags[f.Name] {
+				f.Value.Set(f.DefValue)
+			}
+		})
+		setFlags = make(map[string]bool)
+		for name, value := range req.Flags {
+			if localFlags[name] {
+				continue
+			}
+			if err = flag.Set(name, value); err != nil {
+				log.Println("Set flag failed", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			setFlags[name] = true
 		}
+		paths, err := writeRunFiles(&req)
+		defer func() {
+			for _, path := range paths {
+				os.Remove(path)
+			}
+		}()
+		if err != nil {
+			log.Println("Write run files failed", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		totalWrite, totalQuery, totalMixed, totalRYW = 0, 0, 0, 0
+		atomic.StoreInt32(&cancelled, 0)
+		agentIndex = req.Agent
+		result = NewResult("api-benchmark-real")
+
+		log.Println("Run starts at", req.Start)
+		time.Sleep(req.Start.Sub(time.Now()))
+		run(client, coll)
+
+		result.Interrupted = stopped()
+		body, err := json.Marshal(result)
+		if err != nil {
+			log.Println("Marshal JSON Error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(body)
+		if err != nil {
+			log.Println("Write Response Error", err)
+		}
+	})
+	// the coordinator stops the run in progress when it is interrupted
+	http.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&cancelled, 1)
+		w.WriteHeader(http.StatusOK)
+	})
 
-		if t%(*frequency) == 0 {
-			log.Println("GET", t, float64(*frequency)/time.Since(last).Seconds())
-			last = time.Now()
+	server := &http.Server{Addr: *agentAddr}
+	closed := make(chan struct{})
+	go func() {
+		<-stopping
+		// waits for the run in progress to respond its result
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Println("Shutdown failed", err)
 		}
+		close(closed)
+	}()
+	log.Println("agent running at", *agentAddr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
-	wg.Done()
+	<-closed
 }
 
-func ensureIndexes(coll *mgo.Collection) {
-	for i := 0; i < 20; i++ {
-		err := coll.EnsureIndexKey("key" + strconv.Itoa(i))
+// runTimeout returns how long the coordinator waits for the result of an
+// agent, so a dead or hung one doesn't block it forever.
+func runTimeout() time.Duration {
+	if *agentTimeout > 0 {
+		return *agentTimeout
+	}
+	if *duration == 0 || *scenarioPath != "" {
+		return time.Hour
+	}
+	phases := 0
+	for _, enabled := range []bool{
+		phaseEnabled("qw", *writeCount),
+		phaseEnabled("qr", *queryCount),
+		phaseEnabled("qm", *mixedCount),
+		phaseEnabled("ryw", *rywCount),
+	} {
+		if enabled {
+			phases++
+		}
+	}
+	return *startDelay + time.Duration(phases)*(*warmup+*duration+*cooldown) + time.Minute
+}
+
+// coordinate sends the workload given by the flags to all agents and merges
+// the result documents they respond with. When an agent fails, the others are
+// stopped, and what they measured is merged with the failed one listed.
+func coordinate(addrs []string) {
+	if *saturateMode != "" {
+		log.Fatal("-saturate can't run on agents")
+	}
+
+	req := RunRequest{Flags: make(map[string]string), Files: make(map[string]string), Start: time.Now().Add(*startDelay)}
+	flag.Visit(func(f *flag.Flag) {
+		switch {
+		case localFlags[f.Name]:
+		case fileFlags[f.Name]:
+			content, err := ioutil.ReadFile(f.Value.String())
+			if err != nil {
+				log.Fatal(err)
+			}
+			req.Files[f.Name] = string(content)
+		default:
+			req.Flags[f.Name] = f.Value.String()
+		}
+	})
+
+	var once sync.Once
+	stopAgents := func() {
+		once.Do(func() {
+			stopClient := &http.Client{Timeout: 10 * time.Second}
+			for _, addr := range addrs {
+				resp, err := stopClient.Post("http://"+addr+"/stop", "application/json", nil)
+				if err != nil {
+					log.Printf("Stop agent %s failed: %s\n", addr, err)
+					continue
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+	go func() {
+		<-stopping
+		stopAgents()
+	}()
+
+	client := &http.Client{Timeout: runTimeout()}
+	var wg sync.WaitGroup
+	results := make([]*Result, len(addrs))
+	errs := make([]error, len(addrs))
+	wg.Add(len(addrs))
+	for i, addr := range addrs {
+		req.Agent = i
+		body, err := json.Marshal(&req)
 		if err != nil {
 			log.Fatal(err)
 		}
+		go func(i int, addr string, body []byte) {
+			defer wg.Done()
+			results[i], errs[i] = runAgent(client, addr, body)
+			if errs[i] != nil {
+				log.Printf("Agent %s failed: %s\n", addr, errs[i])
+				stopAgents()
+			}
+		}(i, addr, body)
+	}
+	wg.Wait()
+
+	var merged []*Result
+	for i, r := range results {
+		if errs[i] != nil {
+			result.FailedAgents = append(result.FailedAgents, addrs[i])
+			continue
+		}
+		result.Interrupted = result.Interrupted || r.Interrupted
+		merged = append(merged, r)
+	}
+	mergeResults(merged)
+}
+
+// runAgent posts the RunRequest body to the agent at addr and returns the
+// result document it responds with.
+func runAgent(client *http.Client, addr string, body []byte) (*Result, error) {
+	resp, err := client.Post("http://"+addr+"/run", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responded %d", resp.StatusCode)
+	}
+	var r Result
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, fmt.Errorf("parse result failed: %s", err)
+	}
+	return &r, nil
+}
+
+// mergeResults merges the operations of the same phase and name of all
+// agents into result, merging their histograms and errors and summing their
+// throughput time series interval by interval.
+func mergeResults(results []*Result) {
+	type key struct {
+		phase string
+		op    string
+	}
+	var order []key
+	stats := make(map[key]*Stats)
+	elapsed := make(map[key]time.Duration)
+	intervals := make(map[key][]Interval)
+
+	for _, r := range results {
+		for _, o := range r.Ops {
+			k := key{o.Phase, o.Op}
+			if _, ok := stats[k]; !ok {
+				stats[k] = NewStats()
+				order = append(order, k)
+			}
+			h, err := hdrhistogram.Decode([]byte(o.Histogram))
+			if err != nil {
+				log.Fatalf("Decode histogram of %s %s failed: %s\n", o.Phase, o.Op, err)
+			}
+			stats[k].Latency.Merge(h)
+			for code, n := range o.Errors {
+				stats[k].Errors[code] += n
+			}
+			if d := time.Duration(o.Elapsed * float64(time.Second)); d > elapsed[k] {
+				elapsed[k] = d
+			}
+			for i, interval := range o.Intervals {
+				if i == len(intervals[k]) {
+					intervals[k] = append(intervals[k], Interval{})
+				}
+				merged := &intervals[k][i]
+				if interval.End > merged.End {
+					merged.End = interval.End
+				}
+				merged.Count += interval.Count
+				merged.Rate += interval.Rate
+			}
+		}
+	}
+
+	for _, k := range order {
+		stats[k].Report(k.op, elapsed[k])
+		result.Add(k.phase, k.op, stats[k], elapsed[k], intervals[k])
 	}
 }
 
 func main() {
 	var (
 		session *mgo.Session
-		wg      sync.WaitGroup
+		coll    *mgo.Collection
 		err     error
 	)
 
 	flag.Parse()
+	handleSignals()
+	result = NewResult("api-benchmark-real")
+	if *interval <= 0 {
+		log.Fatal("-interval must be positive")
+	}
+	setFlags = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	sampleFile, err = os.OpenFile(*samplePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
-	if err != nil {
-		log.Fatal(err)
+	if *agentAddrs != "" {
+		coordinate(strings.Split(*agentAddrs, ","))
+		writeResult()
+		if len(result.FailedAgents) > 0 {
+			log.Fatalf("No result from agents %s\n", strings.Join(result.FailedAgents, ","))
+		}
+		return
 	}
-	defer sampleFile.Close()
 
 	transport := http.Transport{
 		Proxy:               nil,
@@ -304,39 +2576,194 @@ func main() {
 	}
 	client := http.Client{Transport: &transport, Timeout: time.Duration(1 * time.Hour)}
 
-	session, err = mgo.DialWithTimeout(*mongoHost, 1*time.Minute)
+	if *mongoHost != "" {
+		session, err = mgo.DialWithTimeout(*mongoHost, 1*time.Minute)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		coll = session.DB(*mongoDb).C(*mongoColl)
+	}
+
+	if *agentAddr != "" {
+		serveAgent(&client, coll)
+		return
+	}
+
+	run(&client, coll)
+	writeResult()
+}
+
+// run runs the workload given by the flags and adds its outcome to result.
+func run(client *http.Client, coll *mgo.Collection) {
+	var wg sync.WaitGroup
+
+	sampleMemoryFile, samples, recentKeys = nil, nil, nil
+	workerSeq = 0
+	chooser = NewChooser(*distribution)
+	schema = nil
+	if *schemaPath != "" {
+		schema = loadSchema(*schemaPath)
+	}
+
+	readOnly := *scenarioPath == "" && *saturateMode == "" && !phaseEnabled("qw", *writeCount) &&
+		!phaseEnabled("qm", *mixedCount) && !phaseEnabled("ryw", *rywCount)
+	sampleWriter, err := OpenSampleWriter(*samplePath, newSampleHeader(schema, *seed), readOnly)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer session.Close()
-	coll := session.DB(*mongoDb).C(*mongoColl)
+	recorder = NewSampleRecorder(sampleWriter, *sampleBatch, *sampleFlush, *sampleSync)
+	defer func() {
+		if sampleMemoryFile != nil {
+			sampleMemoryFile.Close()
+		}
+		if err := recorder.Close(); err != nil {
+			log.Println("Close sample file failed", err)
+		}
+	}()
+
+	if *scenarioPath != "" {
+		scenario := loadScenario(*scenarioPath)
+		if coll != nil {
+			ensureIndexes(coll)
+		}
+		openSamples()
+		recentKeys = NewKeyPool(*recentKeysMax)
+
+		runScenario(client, scenario)
+		return
+	}
+
+	if *saturateMode != "" {
+		if *saturateMode != "rate" && *saturateMode != "concurrency" {
+			log.Fatalf("Unknown -saturate %s\n", *saturateMode)
+		}
+		if *rampMode != "stepped" && *rampMode != "linear" {
+			log.Fatalf("Unknown -ramp %s\n", *rampMode)
+		}
+		switch *saturateMode {
+		case "rate":
+			if *stepStart <= 0 || *stepSize <= 0 {
+				log.Fatal("-step-start and -step-size must be positive")
+			}
+		case "concurrency":
+			if *stepStart < 1 || *stepSize < 1 {
+				log.Fatal("-step-start and -step-size must be at least 1 with -saturate concurrency")
+			}
+		}
+		if coll != nil {
+			ensureIndexes(coll)
+		}
+		openSamples()
+		recentKeys = NewKeyPool(*recentKeysMax)
+
+		saturate(client)
+		return
+	}
 
-	if *writeCount > 0 {
-		ensureIndexes(coll)
+	if phaseEnabled("qw", *writeCount) {
+		if coll != nil {
+			ensureIndexes(coll)
+		}
 
 		wg.Add(*NumberGoroutine)
 
-		last = time.Now()
+		sampler := StartSampler()
+		stats := make([]*Stats, *NumberGoroutine)
+		last = time.Now().UnixNano()
+		phase = NewPhase(*duration, *warmup, *cooldown)
+		pacer = NewPacer(*rate, *arrival)
 		for i := 0; i < *NumberGoroutine; i++ {
-			go write(&client, &wg)
+			stats[i] = NewStats()
+			stats[i].Sampler = sampler
+			go write(client, &wg, newRand(), workerQuota(*writeCount, i, *NumberGoroutine), stats[i])
 		}
 		wg.Wait()
+		report("write", "POST", mergeStats(stats), sampler)
 	}
 
-	if *queryCount > 0 {
-		sampleMemoryFile, err = mmap.Open(*samplePath)
-		defer sampleMemoryFile.Close()
-		if err != nil {
-			log.Fatal(err)
+	if phaseEnabled("qr", *queryCount) {
+		openSamples()
+
+		wg.Add(*NumberGoroutine)
+
+		sampler := StartSampler()
+		stats := make([]*Stats, *NumberGoroutine)
+		last = time.Now().UnixNano()
+		phase = NewPhase(*duration, *warmup, *cooldown)
+		pacer = NewPacer(*rate, *arrival)
+		for i := 0; i < *NumberGoroutine; i++ {
+			stats[i] = NewStats()
+			stats[i].Sampler = sampler
+			go query(client, &wg, newRand(), workerQuota(*queryCount, i, *NumberGoroutine), stats[i])
+		}
+		wg.Wait()
+		report("query", "GET", mergeStats(stats), sampler)
+	}
+
+	if phaseEnabled("qm", *mixedCount) {
+		if coll != nil && !phaseEnabled("qw", *writeCount) {
+			ensureIndexes(coll)
+		}
+		openSamples()
+		recentKeys = NewKeyPool(*recentKeysMax)
+
+		wg.Add(*NumberGoroutine)
+
+		writeSampler := StartSampler()
+		querySampler := StartSampler()
+		writeStats := make([]*Stats, *NumberGoroutine)
+		queryStats := make([]*Stats, *NumberGoroutine)
+		last = time.Now().UnixNano()
+		phase = NewPhase(*duration, *warmup, *cooldown)
+		pacer = NewPacer(*rate, *arrival)
+		for i := 0; i < *NumberGoroutine; i++ {
+			writeStats[i] = NewStats()
+			writeStats[i].Sampler = writeSampler
+			queryStats[i] = NewStats()
+			queryStats[i].Sampler = querySampler
+			go mixed(client, &wg, newRand(), workerQuota(*mixedCount, i, *NumberGoroutine), *mixedCount, *readRatio, writeStats[i], queryStats[i])
+		}
+		wg.Wait()
+		report("mixed", "POST", mergeStats(writeStats), writeSampler)
+		report("mixed", "GET", mergeStats(queryStats), querySampler)
+	}
+
+	if phaseEnabled("ryw", *rywCount) {
+		if *rywSession != "same" && *rywSession != "other" && *rywSession != "any" {
+			log.Fatalf("Unknown -ryw-session %s\n", *rywSession)
+		}
+		if coll != nil && !phaseEnabled("qw", *writeCount) && !phaseEnabled("qm", *mixedCount) {
+			ensureIndexes(coll)
 		}
-		sampleMemoryFileLen = sampleMemoryFile.Len()
 
 		wg.Add(*NumberGoroutine)
 
-		last = time.Now()
+		writeSampler := StartSampler()
+		staleSampler := StartSampler()
+		writeStats := make([]*Stats, *NumberGoroutine)
+		staleStats := make([]*Stats, *NumberGoroutine)
+		last = time.Now().UnixNano()
+		phase = NewPhase(*duration, *warmup, *cooldown)
+		pacer = NewPacer(*rate, *arrival)
 		for i := 0; i < *NumberGoroutine; i++ {
-			go query(&client, &wg)
+			writeStats[i] = NewStats()
+			writeStats[i].Sampler = writeSampler
+			staleStats[i] = NewStats()
+			staleStats[i].Sampler = staleSampler
+			go readYourWrites(client, &wg, newRand(), workerQuota(*rywCount, i, *NumberGoroutine), i, writeStats[i], staleStats[i])
 		}
 		wg.Wait()
+		writes, stale := mergeStats(writeStats), mergeStats(staleStats)
+		report("ryw", "POST", writes, writeSampler)
+		report("ryw", "GET stale", stale, staleSampler)
+
+		checks := writes.Latency.TotalCount()
+		invisible := stale.Latency.TotalCount() + int64(stale.Errors[http.StatusNotFound])
+		ratio := 0.0
+		if checks > 0 {
+			ratio = float64(invisible) / float64(checks) * 100
+		}
+		log.Printf("Read your writes checks=%d invisible=%d (%.3f%%) lost=%d\n", checks, invisible, ratio, stale.Errors[http.StatusNotFound])
 	}
 }
@@ -0,0 +1,329 @@
+// Run with go test api-benchmark-real.go api-benchmark-real_test.go, every
+// program of this directory is its own main package.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pickCounts returns how many times each of n records is picked in draws.
+func pickCounts(t *testing.T, c Chooser, n, draws int) []int {
+	rnd := rand.New(rand.NewSource(1))
+	counts := make([]int, n)
+	for i := 0; i < draws; i++ {
+		pos := c.Next(rnd, n)
+		if pos < 0 || pos >= n {
+			t.Fatalf("%T picked %d of %d records", c, pos, n)
+		}
+		counts[pos]++
+	}
+	return counts
+}
+
+func TestZipfianChooser(t *testing.T) {
+	z := &ZipfianChooser{theta: 0.99}
+	counts := pickCounts(t, z, 1000, 100000)
+	for rank := 1; rank < 10; rank++ {
+		if counts[rank] >= counts[rank-1] {
+			t.Errorf("rank %d picked %d times, not less than rank %d %d times", rank, counts[rank], rank-1, counts[rank-1])
+		}
+	}
+	// rank 0 has 1/zeta(1000) of the picks, about 13%
+	if share := float64(counts[0]) / 100000; share < 0.12 || share > 0.14 {
+		t.Errorf("rank 0 has %.3f of the picks, want about 0.133", share)
+	}
+
+	// the zeta constant follows the number of records up and down
+	for _, n := range []int{1, 2, 5000, 10} {
+		pickCounts(t, z, n, 1000)
+	}
+}
+
+func TestScrambledChooser(t *testing.T) {
+	counts := pickCounts(t, &scrambledChooser{zipf: &ZipfianChooser{theta: 0.99}}, 1000, 100000)
+	top := 0
+	for pos, n := range counts {
+		if n > counts[top] {
+			top = pos
+		}
+	}
+	if top == 0 {
+		t.Error("the most popular record is still the first one")
+	}
+	if share := float64(counts[top]) / 100000; share < 0.12 {
+		t.Errorf("the most popular record has %.3f of the picks, want the share of rank 0", share)
+	}
+}
+
+func TestLatestChooser(t *testing.T) {
+	counts := pickCounts(t, &latestChooser{zipf: &ZipfianChooser{theta: 0.99}}, 1000, 100000)
+	for pos := 0; pos < 999; pos++ {
+		if counts[pos] > counts[999] {
+			t.Fatalf("record %d picked %d times, more than the last one %d times", pos, counts[pos], counts[999])
+		}
+	}
+}
+
+func TestHotspotChooser(t *testing.T) {
+	counts := pickCounts(t, &hotspotChooser{fraction: 0.2, ops: 0.8}, 100, 100000)
+	hot := 0
+	for _, n := range counts[:20] {
+		hot += n
+	}
+	if share := float64(hot) / 100000; share < 0.79 || share > 0.81 {
+		t.Errorf("hot records have %.3f of the picks, want 0.8", share)
+	}
+
+	// at least one record is hot, and all of them when the hot fraction
+	// covers them
+	pickCounts(t, &hotspotChooser{fraction: 0.2, ops: 0.8}, 2, 1000)
+	if counts := pickCounts(t, &hotspotChooser{fraction: 1, ops: 0}, 10, 1000); counts[9] == 0 {
+		t.Error("the last record is never picked with -hot-fraction 1")
+	}
+}
+
+// writeSamples appends the records of keys to the sample file at path.
+func writeSamples(t *testing.T, path string, header SampleHeader, keys ...string) {
+	w, err := OpenSampleWriter(path, header, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		record, err := w.pad([]byte(fmt.Sprintf(`{"key0":%q}`, key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSamples returns the records of the sample file at path.
+func readSamples(t *testing.T, path string) (*SampleReader, []string) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewSampleReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	for i := 0; i < r.Len(); i++ {
+		record, err := r.Record(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, string(record))
+	}
+	return r, records
+}
+
+func TestSampleFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samples")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sample.data")
+
+	header := newSampleHeader(nil, 7)
+	writeSamples(t, path, header, "a", "b")
+	writeSamples(t, path, header, "c")
+	r, records := readSamples(t, path)
+	want := `{"key0":"a"} {"key0":"b"} {"key0":"c"}`
+	if got := strings.Join(records, " "); got != want {
+		t.Errorf("records %s, want %s", got, want)
+	}
+	if r.Header.Count != 3 || r.Header.Seed != 7 || r.Header.Partitions != 1 || r.Header.HeaderSize%512 != 0 {
+		t.Errorf("header %+v", r.Header)
+	}
+
+	// a partial record left by a crash is ignored, then dropped by the next
+	// writer
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"key0":"partial`)
+	file.Close()
+	if _, records = readSamples(t, path); len(records) != 3 {
+		t.Errorf("%d records with a partial one, want 3", len(records))
+	}
+	writeSamples(t, path, header, "d")
+	if _, records = readSamples(t, path); len(records) != 4 || records[3] != `{"key0":"d"}` {
+		t.Errorf("records %v after the partial one, want d last", records)
+	}
+
+	w, err := OpenSampleWriter(path, header, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.pad([]byte(strings.Repeat("x", int(header.RecordSize)))); err == nil {
+		t.Error("a record longer than RecordSize was padded")
+	}
+	w.Close()
+}
+
+func TestSampleFileChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samples")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sample.data")
+	header := newSampleHeader(nil, 7)
+	writeSamples(t, path, header, "a")
+
+	other := newSampleHeader(nil, 8)
+	if _, err = OpenSampleWriter(path, other, false); err == nil || !strings.Contains(err.Error(), "seed") {
+		t.Errorf("appending records of another seed: %v", err)
+	}
+	w, err := OpenSampleWriter(path, other, true)
+	if err != nil {
+		t.Errorf("reading records of another seed: %v", err)
+	} else {
+		w.Close()
+	}
+	other = newSampleHeader(nil, 7)
+	other.Partitions = 4
+	if _, err = OpenSampleWriter(path, other, true); err == nil || !strings.Contains(err.Error(), "partitions") {
+		t.Errorf("records of another partition count: %v", err)
+	}
+	other = newSampleHeader(nil, 7)
+	other.RecordSize++
+	if _, err = OpenSampleWriter(path, other, true); err == nil {
+		t.Error("records of another size were accepted")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content []byte
+		err     string
+	}{
+		{"version", bytes.Replace(content, []byte(`"version":1`), []byte(`"version":2`), 1), "unsupported sample file version 2"},
+		{"format", bytes.Replace(content, []byte(sampleFormat), []byte("other"), 1), "not a sample file"},
+		{"count", bytes.Replace(content, []byte(`"count":1`), []byte(`"count":2`), 1), "sample file has 1 records, its header 2"},
+		{"plain text", []byte("key0\naa\n"), "not a sample file"},
+	}
+	for _, test := range tests {
+		_, _, err := readSampleHeader(bytes.NewReader(test.content), int64(len(test.content)))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: %v, want %s", test.name, err, test.err)
+		}
+	}
+}
+
+func TestSampleRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samples")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sample.data")
+
+	w, err := OpenSampleWriter(path, newSampleHeader(nil, 0), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewSampleRecorder(w, 4, time.Hour, "close")
+	for i := 0; i < 10; i++ {
+		if err = r.Record([]byte(fmt.Sprintf(`{"key0":"%d"}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a flush writes the records queued before it
+	if err = r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, records := readSamples(t, path); len(records) != 10 {
+		t.Errorf("%d records after Flush, want 10", len(records))
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Record([]byte(`{"key0":"late"}`)); err != errRecorderClosed {
+		t.Errorf("Record after Close: %v", err)
+	}
+	if err = r.Close(); err != errRecorderClosed {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+const testSchema = `
+fields:
+  - {name: user, type: string, min: 12, max: 40, index: true}
+  - {name: age, type: int, max: 120, index: true}
+  - {name: created, type: date, index: true}
+  - {name: attr, type: string, count: 3, min: 8, max: 8}
+  - name: profile
+    type: nested
+    fields:
+      - {name: city, type: string, min: 24, max: 24, index: true}
+  - {name: tags, type: array, max: 4, items: {type: string, min: 4, max: 6}}
+`
+
+func TestSchemaRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.yaml")
+	if err = ioutil.WriteFile(path, []byte(testSchema), 0600); err != nil {
+		t.Fatal(err)
+	}
+	schema := loadSchema(path)
+	if want := []string{"user", "age", "created", "profile.city"}; !reflect.DeepEqual(schema.indexes, want) {
+		t.Fatalf("indexes %v, want %v", schema.indexes, want)
+	}
+
+	var records []map[string]interface{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(i)
+		doc := schema.Generate(key)
+		if !reflect.DeepEqual(doc, schema.Generate(key)) {
+			t.Fatalf("document of key %s changed", key)
+		}
+		record := schema.Record(doc)
+		line, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(line)) >= schema.recordSize() {
+			t.Fatalf("record %s doesn't fit in %d bytes", line, schema.recordSize())
+		}
+		records = append(records, record)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		miss := schema.MissRecord(rnd)
+		for _, path := range schema.indexes {
+			for _, record := range records {
+				if reflect.DeepEqual(miss[path], record[path]) {
+					t.Fatalf("miss value %v of %s was generated", miss[path], path)
+				}
+			}
+		}
+	}
+}
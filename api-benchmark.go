@@ -1,14 +1,26 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
 )
 
 var (
@@ -18,16 +30,464 @@ var (
 	queryCount      = flag.Uint64("qr", 0, "number of query")
 	sampleCount     = flag.Uint64("qs", 2000, "number of samples")
 	frequency       = flag.Uint64("frequency", 100000, "benchmark frequency")
+	rate            = flag.Float64("rate", 0, "target requests per second of all goroutines, 0 means closed-loop")
+	arrival         = flag.String("arrival", "constant", "arrival of requests in -rate mode, constant or poisson")
+	duration        = flag.Duration("duration", 0, "measured length of each phase, 0 means bounded by counts only")
+	warmup          = flag.Duration("warmup", 0, "length of the unrecorded window before measurement")
+	cooldown        = flag.Duration("cooldown", 0, "length of the unrecorded window after -duration")
+	interval        = flag.Duration("interval", time.Second, "sampling interval of the throughput time series")
+	resultJSON      = flag.String("result-json", "", "write the result document of the run to this JSON file")
+	resultCSV       = flag.String("result-csv", "", "write the summary and throughput time series of the run to this CSV file")
 	totalWrite      = uint64(0)
 	totalQuery      = uint64(0)
-	last            time.Time
+	last            = int64(0)
+	phase           *Phase
+	result          *Result
+	pacer           *Pacer
+	setFlags        map[string]bool
 )
 
-func write(client *http.Client, done chan<- bool) {
+// Stats collects the latencies and failures of one operation type.
+// Each worker owns its Stats, they are merged once all workers are done.
+type Stats struct {
+	Latency *hdrhistogram.Histogram
+	// Sampler, if set, counts every completed operation including those
+	// outside the measurement window.
+	Sampler *Sampler
+	// Errors counts failures by HTTP status code, 0 means the request failed
+	// before any response was received.
+	Errors map[int]uint64
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		Latency: hdrhistogram.New(1, int64(time.Hour/time.Microsecond), 3),
+		Errors:  make(map[int]uint64),
+	}
+}
+
+// Record records the latency of an operation started at start, unless it
+// started outside the measurement window of the current phase.
+func (s *Stats) Record(start time.Time) {
+	if s.Sampler != nil {
+		s.Sampler.Add()
+	}
+	if phase.Measuring(start) {
+		s.Latency.RecordValue(int64(time.Since(start) / time.Microsecond))
+	}
+}
+
+func (s *Stats) RecordError(start time.Time, code int) {
+	if phase.Measuring(start) {
+		s.Errors[code]++
+	}
+}
+
+func (s *Stats) Merge(other *Stats) {
+	s.Latency.Merge(other.Latency)
+	for code, n := range other.Errors {
+		s.Errors[code] += n
+	}
+}
+
+func mergeStats(all []*Stats) *Stats {
+	merged := NewStats()
+	for _, s := range all {
+		merged.Merge(s)
+	}
+	return merged
+}
+
+func (s *Stats) Report(op string, elapsed time.Duration) {
+	ms := func(q float64) float64 {
+		return float64(s.Latency.ValueAtQuantile(q)) / 1000
+	}
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(s.Latency.TotalCount()) / elapsed.Seconds()
+	}
+	log.Printf("%s count=%d rate=%.1f/s p50=%.3fms p90=%.3fms p99=%.3fms p99.9=%.3fms max=%.3fms\n",
+		op, s.Latency.TotalCount(), rate, ms(50), ms(90), ms(99), ms(99.9), float64(s.Latency.Max())/1000)
+
+	codes := make([]int, 0, len(s.Errors))
+	for code := range s.Errors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		log.Printf("%s errors status=%d count=%d\n", op, code, s.Errors[code])
+	}
+}
+
+// Sampler counts completed operations and samples the count every -interval
+// to build a throughput time series.
+type Sampler struct {
+	ops       uint64
+	last      time.Time
+	lastOps   uint64
+	start     time.Time
+	intervals []Interval
+	stop      chan bool
+	done      chan bool
+}
+
+func StartSampler() *Sampler {
+	now := time.Now()
+	s := &Sampler{start: now, last: now, stop: make(chan bool), done: make(chan bool)}
+	go s.run()
+	return s
+}
+
+func (s *Sampler) Add() {
+	atomic.AddUint64(&s.ops, 1)
+}
+
+func (s *Sampler) run() {
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sample(now)
+		case <-s.stop:
+			s.sample(time.Now())
+			close(s.done)
+			return
+		}
+	}
+}
+
+func (s *Sampler) sample(now time.Time) {
+	ops := atomic.LoadUint64(&s.ops)
+	s.intervals = append(s.intervals, Interval{
+		End:   now.Sub(s.start).Seconds(),
+		Count: ops - s.lastOps,
+		Rate:  float64(ops-s.lastOps) / now.Sub(s.last).Seconds(),
+	})
+	s.last, s.lastOps = now, ops
+}
+
+// Stop stops sampling and returns the time series.
+func (s *Sampler) Stop() []Interval {
+	close(s.stop)
+	<-s.done
+	return s.intervals
+}
+
+type Interval struct {
+	End   float64 `json:"end_seconds"`
+	Count uint64  `json:"count"`
+	Rate  float64 `json:"rate"`
+}
+
+// Result is the machine-readable outcome of a run, written by -result-json
+// and -result-csv.
+type Result struct {
+	Program string            `json:"program"`
+	Start   time.Time         `json:"start"`
+	Flags   map[string]string `json:"flags"`
+	Ops     []*OpResult       `json:"ops"`
+	// Interrupted is set when a signal stopped the run early, leaving phases
+	// short or skipped.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+type OpResult struct {
+	Phase     string             `json:"phase"`
+	Op        string             `json:"op"`
+	Count     int64              `json:"count"`
+	Elapsed   float64            `json:"elapsed_seconds"`
+	Rate      float64            `json:"rate"`
+	Latency   map[string]float64 `json:"latency_ms"`
+	Errors    map[int]uint64     `json:"errors"`
+	Intervals []Interval         `json:"intervals"`
+	// Histogram is the latency histogram in microseconds in the base64
+	// HdrHistogram V2 compressed encoding.
+	Histogram string `json:"histogram"`
+}
+
+func NewResult(program string) *Result {
+	r := &Result{Program: program, Start: time.Now(), Flags: make(map[string]string)}
+	flag.VisitAll(func(f *flag.Flag) {
+		r.Flags[f.Name] = f.Value.String()
+	})
+	return r
+}
+
+var percentiles = []struct {
+	name     string
+	quantile float64
+}{{"p50", 50}, {"p90", 90}, {"p99", 99}, {"p99.9", 99.9}}
+
+func (r *Result) Add(phaseName, op string, stats *Stats, elapsed time.Duration, intervals []Interval) {
+	opResult := &OpResult{
+		Phase:     phaseName,
+		Op:        op,
+		Count:     stats.Latency.TotalCount(),
+		Elapsed:   elapsed.Seconds(),
+		Latency:   make(map[string]float64),
+		Errors:    stats.Errors,
+		Intervals: intervals,
+	}
+	if encoded, err := stats.Latency.Encode(hdrhistogram.V2CompressedEncodingCookieBase); err == nil {
+		opResult.Histogram = string(encoded)
+	} else {
+		log.Println("Encode histogram failed", err)
+	}
+	if elapsed > 0 {
+		opResult.Rate = float64(opResult.Count) / elapsed.Seconds()
+	}
+	for _, p := range percentiles {
+		opResult.Latency[p.name] = float64(stats.Latency.ValueAtQuantile(p.quantile)) / 1000
+	}
+	opResult.Latency["max"] = float64(stats.Latency.Max()) / 1000
+	opResult.Latency["mean"] = stats.Latency.Mean() / 1000
+	r.Ops = append(r.Ops, opResult)
+}
+
+func (r *Result) WriteJSON(path string) error {
+	body, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, body, 0644)
+}
+
+// WriteCSV writes one summary row per operation followed by one row per
+// interval of its time series, which leaves the latency columns empty.
+func (r *Result) WriteCSV(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	header := []string{"phase", "op", "interval_end_seconds", "count", "rate"}
+	for _, p := range percentiles {
+		header = append(header, p.name+"_ms")
+	}
+	header = append(header, "max_ms", "mean_ms", "errors")
+	w.Write(header)
+
+	for _, op := range r.Ops {
+		errors := uint64(0)
+		for _, n := range op.Errors {
+			errors += n
+		}
+		row := []string{op.Phase, op.Op, "total", strconv.FormatInt(op.Count, 10), formatFloat(op.Rate)}
+		for _, p := range percentiles {
+			row = append(row, formatFloat(op.Latency[p.name]))
+		}
+		row = append(row, formatFloat(op.Latency["max"]), formatFloat(op.Latency["mean"]), strconv.FormatUint(errors, 10))
+		w.Write(row)
+
+		for _, interval := range op.Intervals {
+			row := []string{op.Phase, op.Op, formatFloat(interval.End), strconv.FormatUint(interval.Count, 10), formatFloat(interval.Rate)}
+			for i := 0; i < len(percentiles)+3; i++ {
+				row = append(row, "")
+			}
+			w.Write(row)
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
+
+// report logs the outcome of one operation type of the current phase and
+// adds it to the result document.
+func report(phaseName, op string, stats *Stats, sampler *Sampler) {
+	elapsed := phase.Elapsed()
+	stats.Report(op, elapsed)
+	result.Add(phaseName, op, stats, elapsed, sampler.Stop())
+}
+
+func writeResult() {
+	result.Interrupted = stopped()
+	if *resultJSON != "" {
+		if err := result.WriteJSON(*resultJSON); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *resultCSV != "" {
+		if err := result.WriteCSV(*resultCSV); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Phase bounds one benchmark phase in time. Operations started during the
+// warmup or cooldown windows are sent but not recorded.
+type Phase struct {
+	measureFrom time.Time
+	measureTo   time.Time
+	end         time.Time
+}
+
+func NewPhase(duration, warmup, cooldown time.Duration) *Phase {
+	p := &Phase{measureFrom: time.Now().Add(warmup)}
+	if duration > 0 {
+		p.measureTo = p.measureFrom.Add(duration)
+		p.end = p.measureTo.Add(cooldown)
+	}
+	return p
+}
+
+// Over reports whether a duration-based phase has finished, or the run has
+// been stopped.
+func (p *Phase) Over() bool {
+	return stopped() || (!p.end.IsZero() && time.Now().After(p.end))
+}
+
+// Measuring reports whether an operation started at t should be recorded.
+func (p *Phase) Measuring(t time.Time) bool {
+	return !t.Before(p.measureFrom) && (p.measureTo.IsZero() || t.Before(p.measureTo))
+}
+
+// Elapsed returns how long the measurement window has lasted so far.
+func (p *Phase) Elapsed() time.Duration {
+	to := time.Now()
+	if !p.measureTo.IsZero() && to.After(p.measureTo) {
+		to = p.measureTo
+	}
+	if to.Before(p.measureFrom) {
+		return 0
+	}
+	return to.Sub(p.measureFrom)
+}
+
+// phaseEnabled reports whether the phase counted by the flag name should run.
+// With -duration, giving the flag at all enables it and 0 means no count limit.
+func phaseEnabled(name string, count uint64) bool {
+	return !stopped() && (count > 0 || (*duration > 0 && setFlags[name]))
+}
+
+// stopping is closed by the first SIGINT or SIGTERM. It ends the current
+// phase and skips the next ones, so the requests in flight drain and the run
+// still reports what it has measured. A second signal exits at once.
+var stopping = make(chan struct{})
+
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Got %s, stopping after the requests in flight, again to exit now\n", sig)
+		close(stopping)
+		<-signals
+		os.Exit(1)
+	}()
+}
+
+// stopped reports whether the run has been stopped by a signal.
+func stopped() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pacer hands out the intended start times of an open-loop schedule shared
+// by all workers, so a slow response doesn't delay the requests behind it.
+type Pacer struct {
+	lock     sync.Mutex
+	start    time.Time
+	next     time.Time
+	rateFrom float64
+	rateTo   float64
+	over     time.Duration
+	poisson  bool
+	rnd      *rand.Rand
+}
+
+// NewPacer returns nil when rate is not positive, which means closed-loop.
+func NewPacer(rate float64, arrival string) *Pacer {
+	return NewRampPacer(rate, rate, 0, arrival)
+}
+
+// NewRampPacer changes the rate linearly from rateFrom to rateTo over the
+// given duration and keeps rateTo afterwards.
+func NewRampPacer(rateFrom, rateTo float64, over time.Duration, arrival string) *Pacer {
+	if rateFrom <= 0 && rateTo <= 0 {
+		return nil
+	}
+	now := time.Now()
+	pacer := &Pacer{
+		start:    now,
+		next:     now,
+		rateFrom: rateFrom,
+		rateTo:   rateTo,
+		over:     over,
+	}
+	switch arrival {
+	case "constant":
+	case "poisson":
+		pacer.poisson = true
+		pacer.rnd = newRand()
+	default:
+		log.Fatalf("Unknown arrival %s\n", arrival)
+	}
+	return pacer
+}
+
+// gap returns the mean time between two starts at the current point of the
+// schedule, the rate never goes below one operation per second.
+func (p *Pacer) gap() time.Duration {
+	rate := p.rateTo
+	if elapsed := p.next.Sub(p.start); elapsed < p.over {
+		rate = p.rateFrom + (p.rateTo-p.rateFrom)*float64(elapsed)/float64(p.over)
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// Wait blocks until the next intended start time and returns it. Latency
+// should be measured from the returned time so that queueing behind slow
+// requests is counted. A nil Pacer returns the current time immediately.
+func (p *Pacer) Wait() time.Time {
+	if p == nil {
+		return time.Now()
+	}
+	p.lock.Lock()
+	start := p.next
+	if p.poisson {
+		p.next = p.next.Add(time.Duration(p.rnd.ExpFloat64() * float64(p.gap())))
+	} else {
+		p.next = p.next.Add(p.gap())
+	}
+	p.lock.Unlock()
+
+	if d := start.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+	return start
+}
+
+// newRand returns a new random source.
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// logThroughput logs the rate of the last frequency operations.
+func logThroughput(op string, t uint64) {
+	now := time.Now().UnixNano()
+	prev := atomic.SwapInt64(&last, now)
+	log.Println(op, t, float64(*frequency)/time.Duration(now-prev).Seconds())
+}
+
+func write(client *http.Client, done chan<- bool, stats *Stats) {
 	var t uint64
 	count := *writeCount
 	for {
-		if t = atomic.AddUint64(&totalWrite, 1); count > 0 && t > count {
+		if t = atomic.AddUint64(&totalWrite, 1); (count > 0 && t > count) || phase.Over() {
 			break
 		}
 
@@ -37,30 +497,34 @@ func write(client *http.Client, done chan<- bool) {
 			continue
 		}
 
+		start := pacer.Wait()
 		resp, err := client.Do(req)
 		if err != nil {
 			log.Println(err)
+			stats.RecordError(start, 0)
 			continue
 		}
+		resp.Body.Close()
+		stats.Record(start)
 
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			log.Println("POST Error", resp.StatusCode)
+			stats.RecordError(start, resp.StatusCode)
 			continue
 		}
 
 		if t%(*frequency) == 0 {
-			log.Println("POST", t, float64(*frequency)/time.Since(last).Seconds())
-			last = time.Now()
+			logThroughput("POST", t)
 		}
 	}
 	done <- true
 }
 
-func query(client *http.Client, done chan<- bool) {
+func query(client *http.Client, done chan<- bool, stats *Stats) {
 	var t uint64
 	count := *queryCount
 	for {
-		if t = atomic.AddUint64(&totalQuery, 1); count > 0 && t > count {
+		if t = atomic.AddUint64(&totalQuery, 1); (count > 0 && t > count) || phase.Over() {
 			break
 		}
 
@@ -70,20 +534,24 @@ func query(client *http.Client, done chan<- bool) {
 			continue
 		}
 
+		start := pacer.Wait()
 		resp, err := client.Do(req)
 		if err != nil {
 			log.Println(err)
+			stats.RecordError(start, 0)
 			continue
 		}
+		resp.Body.Close()
+		stats.Record(start)
 
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			log.Println("GET Error", resp.StatusCode)
+			stats.RecordError(start, resp.StatusCode)
 			continue
 		}
 
 		if t%(*frequency) == 0 {
-			log.Println("GET", t, float64(*frequency)/time.Since(last).Seconds())
-			last = time.Now()
+			logThroughput("GET", t)
 		}
 	}
 	done <- true
@@ -107,6 +575,15 @@ func prepareForSearch(client *http.Client) {
 
 func main() {
 	flag.Parse()
+	handleSignals()
+	setFlags = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	result = NewResult("api-benchmark")
+	if *interval <= 0 {
+		log.Fatal("-interval must be positive")
+	}
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	transport := &http.Transport{
@@ -121,28 +598,44 @@ func main() {
 		done[i] = make(chan bool, 1)
 	}
 
-	last = time.Now()
-	if *writeCount > 0 {
+	if phaseEnabled("qw", *writeCount) {
+		sampler := StartSampler()
+		stats := make([]*Stats, *NumberGoroutine)
+		last = time.Now().UnixNano()
+		phase = NewPhase(*duration, *warmup, *cooldown)
+		pacer = NewPacer(*rate, *arrival)
 		for i := 0; i < *NumberGoroutine; i++ {
-			go write(&client, done[i])
+			stats[i] = NewStats()
+			stats[i].Sampler = sampler
+			go write(&client, done[i], stats[i])
 		}
 		for i := 0; i < *NumberGoroutine; i++ {
 			<-done[i]
 		}
+		report("write", "POST", mergeStats(stats), sampler)
 	}
 
-	if *queryCount > 0 {
+	if phaseEnabled("qr", *queryCount) {
 		prepareForSearch(&client)
 
-		last = time.Now()
+		sampler := StartSampler()
+		stats := make([]*Stats, *NumberGoroutine)
+		last = time.Now().UnixNano()
+		phase = NewPhase(*duration, *warmup, *cooldown)
+		pacer = NewPacer(*rate, *arrival)
 		for i := 0; i < *NumberGoroutine; i++ {
-			go query(&client, done[i])
+			stats[i] = NewStats()
+			stats[i].Sampler = sampler
+			go query(&client, done[i], stats[i])
 		}
 		for i := 0; i < *NumberGoroutine; i++ {
 			<-done[i]
 		}
+		report("query", "GET", mergeStats(stats), sampler)
 	}
 
+	writeResult()
+
 	for _, channel := range done {
 		close(channel)
 	}
@@ -1,49 +1,385 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	prometheus "github.com/prometheus/client_golang/prometheus"
+	promhttp "github.com/prometheus/client_golang/prometheus/promhttp"
 	mgo "gopkg.in/mgo.v2"
 )
 
-type Doc map[string]string
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apiserver_requests_total",
+		Help: "Number of HTTP requests by method and status code.",
+	}, []string{"method", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apiserver_request_duration_seconds",
+		Help:    "HTTP request latency by handler.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18),
+	}, []string{"handler"})
+	requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "apiserver_requests_in_flight",
+		Help: "Number of HTTP requests being served.",
+	})
+	mongoErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apiserver_mongo_errors_total",
+		Help: "Number of failed MongoDB operations by operation.",
+	}, []string{"op"})
+	mongoSessionUsage = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apiserver_mongo_session_usage_total",
+		Help: "Number of times each MongoDB session was picked by the round-robin pool.",
+	}, []string{"session"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, requestsInFlight, mongoErrors, mongoSessionUsage)
+}
+
+type Doc map[string]interface{}
+
+var ErrNotFound = errors.New("not found")
+
+// sessionHeader pins the operation of a request to one session of the pool,
+// so clients can tell apart reads through the session of their write and
+// through another one.
+const sessionHeader = "X-Mongo-Session"
+
+// readModeHeader overrides -read-mode for the operation of a request, e.g. to
+// read from secondaries.
+const readModeHeader = "X-Mongo-Read-Mode"
+
+// DocStore is the storage backend behind Server.
+type DocStore interface {
+	Insert(doc Doc) error
+	// FindOne returns ErrNotFound if no document matches query.
+	FindOne(query Doc) (Doc, error)
+	Count(query Doc) (int, error)
+	EnsureIndexes(keys []string) error
+	// Session returns a DocStore running every operation on the n-th session
+	// of the pool, modulo its size.
+	Session(n int) DocStore
+	// ReadMode returns a DocStore running every operation in mode.
+	ReadMode(mode mgo.Mode) DocStore
+}
+
+// MgoStore spreads operations over a pool of mgo sessions in round-robin.
+type MgoStore struct {
+	idx   uint32
+	colls []*mgo.Collection
+	// pinned stores run every operation on the session pin instead.
+	pinned bool
+	pin    uint32
+	modes  *modeStores
+}
+
+// modeStores holds the stores of copies of the sessions in other read modes,
+// made on first use and shared by all the views of a store.
+type modeStores struct {
+	lock   sync.Mutex
+	stores map[mgo.Mode]*MgoStore
+}
+
+func (s *MgoStore) Insert(doc Doc) error {
+	err := s.getCollection().Insert(doc)
+	if err != nil {
+		mongoErrors.WithLabelValues("insert").Inc()
+	}
+	return err
+}
+
+func (s *MgoStore) FindOne(query Doc) (Doc, error) {
+	var results []Doc
+	err := s.getCollection().Find(query).Limit(1).All(&results)
+	if err != nil {
+		mongoErrors.WithLabelValues("find").Inc()
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, ErrNotFound
+	}
+	return results[0], nil
+}
+
+func (s *MgoStore) Count(query Doc) (int, error) {
+	n, err := s.getCollection().Find(query).Count()
+	if err != nil {
+		mongoErrors.WithLabelValues("count").Inc()
+	}
+	return n, err
+}
+
+func (s *MgoStore) EnsureIndexes(keys []string) error {
+	coll := s.getCollection()
+	for _, key := range keys {
+		err := coll.EnsureIndexKey(key)
+		if err != nil {
+			mongoErrors.WithLabelValues("ensure_index").Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MgoStore) Session(n int) DocStore {
+	return &MgoStore{colls: s.colls, pinned: true, pin: uint32(n % len(s.colls)), modes: s.modes}
+}
+
+func (s *MgoStore) ReadMode(mode mgo.Mode) DocStore {
+	s.modes.lock.Lock()
+	defer s.modes.lock.Unlock()
+	store, ok := s.modes.stores[mode]
+	if !ok {
+		store = &MgoStore{colls: make([]*mgo.Collection, len(s.colls)), modes: s.modes}
+		for i, coll := range s.colls {
+			session := coll.Database.Session.Copy()
+			session.SetMode(mode, true)
+			store.colls[i] = coll.With(session)
+		}
+		s.modes.stores[mode] = store
+	}
+	return store
+}
+
+// closeModes closes the sessions copied by ReadMode.
+func (s *MgoStore) closeModes() {
+	s.modes.lock.Lock()
+	defer s.modes.lock.Unlock()
+	for _, store := range s.modes.stores {
+		for _, coll := range store.colls {
+			coll.Database.Session.Close()
+		}
+	}
+}
+
+func (s *MgoStore) getCollection() *mgo.Collection {
+	id := s.pin
+	if !s.pinned {
+		id = atomic.AddUint32(&s.idx, 1) % uint32(len(s.colls))
+	}
+	mongoSessionUsage.WithLabelValues(strconv.Itoa(int(id))).Inc()
+	return s.colls[id]
+}
+
+// MemoryStore keeps all documents in process, so the API can run without MongoDB.
+type MemoryStore struct {
+	lock    sync.RWMutex
+	docs    []Doc
+	indexes map[string]map[string][]int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{indexes: make(map[string]map[string][]int)}
+}
+
+// Session returns s itself, there is a single view of a MemoryStore.
+func (s *MemoryStore) Session(n int) DocStore {
+	return s
+}
+
+// ReadMode returns s itself, a MemoryStore is always consistent.
+func (s *MemoryStore) ReadMode(mode mgo.Mode) DocStore {
+	return s
+}
+
+func (s *MemoryStore) Insert(doc Doc) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pos := len(s.docs)
+	s.docs = append(s.docs, doc)
+	for key, index := range s.indexes {
+		if value := lookup(doc, key); value != nil {
+			index[indexKey(value)] = append(index[indexKey(value)], pos)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) FindOne(query Doc) (Doc, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var found Doc
+	s.scan(query, func(doc Doc) bool {
+		found = doc
+		return false
+	})
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+func (s *MemoryStore) Count(query Doc) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	n := 0
+	s.scan(query, func(doc Doc) bool {
+		n++
+		return true
+	})
+	return n, nil
+}
+
+func (s *MemoryStore) EnsureIndexes(keys []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, key := range keys {
+		if _, ok := s.indexes[key]; ok {
+			continue
+		}
+		index := make(map[string][]int)
+		for pos, doc := range s.docs {
+			if value := lookup(doc, key); value != nil {
+				index[indexKey(value)] = append(index[indexKey(value)], pos)
+			}
+		}
+		s.indexes[key] = index
+	}
+	return nil
+}
+
+// scan calls fn for every document matching query until fn returns false,
+// using an index when one of the queried keys has one.
+func (s *MemoryStore) scan(query Doc, fn func(Doc) bool) {
+	for key, value := range query {
+		if index, ok := s.indexes[key]; ok {
+			for _, pos := range index[indexKey(value)] {
+				if matches(s.docs[pos], query) && !fn(s.docs[pos]) {
+					return
+				}
+			}
+			return
+		}
+	}
+	for _, doc := range s.docs {
+		if matches(doc, query) && !fn(doc) {
+			return
+		}
+	}
+}
+
+// matches reports whether doc has every value of query, the keys of query
+// may be dotted paths into nested documents.
+func matches(doc, query Doc) bool {
+	for key, value := range query {
+		if v := lookup(doc, key); v == nil || !reflect.DeepEqual(v, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the value at the dotted path of doc, nil if there is none.
+func lookup(doc map[string]interface{}, path string) interface{} {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+// indexKey returns the key of value in the indexes, its JSON encoding.
+func indexKey(value interface{}) string {
+	body, _ := json.Marshal(value)
+	return string(body)
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
 
 type Server struct {
 	debug   bool
 	verbose bool
-	idx     uint32
-	colls   []*mgo.Collection
+	store   DocStore
 	samples []Doc
 }
 
 func (s *Server) Root(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+	// any other method is labeled other, the client chooses it
+	method := "other"
 	switch r.Method {
 	case "GET":
-		s.find(w, r)
+		method = r.Method
+		s.find(rec, r)
+		requestDuration.WithLabelValues("find").Observe(time.Since(start).Seconds())
 	case "POST":
-		s.insert(w, r)
+		method = r.Method
+		s.insert(rec, r)
+		requestDuration.WithLabelValues("insert").Observe(time.Since(start).Seconds())
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		rec.WriteHeader(http.StatusMethodNotAllowed)
 	}
+	requestsTotal.WithLabelValues(method, strconv.Itoa(rec.code)).Inc()
 	if s.verbose {
 		log.Println(r.Method, r.ContentLength, r.URL.Path, time.Since(start).Seconds()*1000, "ms")
 	}
 }
 
+// storeFor returns the store serving r, in another read mode if r has the
+// readModeHeader and pinned to a session if it has the sessionHeader.
+func (s *Server) storeFor(r *http.Request) (DocStore, error) {
+	store := s.store
+	if value := r.Header.Get(readModeHeader); value != "" {
+		mode, err := parseReadMode(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", readModeHeader, value)
+		}
+		store = store.ReadMode(mode)
+	}
+
+	value := r.Header.Get(sessionHeader)
+	if value == "" {
+		return store, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", sessionHeader, value)
+	}
+	return store.Session(n), nil
+}
+
 func (s *Server) find(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	if len(r.Header["Content-Type"]) <= 0 || !strings.Contains(r.Header["Content-Type"][0], "json") {
-		log.Printf("Content-Type must be JSON but %d\n", r.Header["Content-Type"])
+		log.Printf("Content-Type must be JSON but %v\n", r.Header["Content-Type"])
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -56,7 +392,7 @@ func (s *Server) find(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body.Close()
 
-	var query map[string]string
+	var query Doc
 	err = json.Unmarshal(body, &query)
 	if err != nil {
 		log.Println("Parse Body Failed", err)
@@ -64,15 +400,21 @@ func (s *Server) find(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var results []map[string]string
-	err = s.getCollection().Find(query).Limit(1).All(&results)
+	store, err := s.storeFor(r)
 	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := store.FindOne(query)
+	if err != nil && err != ErrNotFound {
 		log.Println("Find from db Failed", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if len(results) > 0 {
-		respBody, err := json.Marshal(results[0])
+	if err == nil {
+		respBody, err := json.Marshal(result)
 		if err != nil {
 			log.Println("Marshal JSON Error", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -93,7 +435,7 @@ func (s *Server) insert(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	if len(r.Header["Content-Type"]) <= 0 || !strings.Contains(r.Header["Content-Type"][0], "json") {
-		log.Printf("Content-Type must be JSON but %d\n", r.Header["Content-Type"])
+		log.Printf("Content-Type must be JSON but %v\n", r.Header["Content-Type"])
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -106,7 +448,7 @@ func (s *Server) insert(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body.Close()
 
-	var doc map[string]string
+	var doc Doc
 	err = json.Unmarshal(body, &doc)
 	if err != nil {
 		log.Println("Parse Body Failed", err)
@@ -114,7 +456,14 @@ func (s *Server) insert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.getCollection().Insert(doc)
+	store, err := s.storeFor(r)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = store.Insert(doc)
 	if err != nil {
 		log.Println("Insert to db Failed", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -123,9 +472,56 @@ func (s *Server) insert(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (s *Server) getCollection() *mgo.Collection {
-	id := atomic.AddUint32(&s.idx, 1) % uint32(len(s.colls))
-	return s.colls[id]
+// readModes are the mgo consistency modes by their lowercase names.
+var readModes = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primarypreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondarypreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+	"eventual":           mgo.Eventual,
+	"monotonic":          mgo.Monotonic,
+	"strong":             mgo.Strong,
+}
+
+// parseReadMode returns the mgo mode named name, in any case.
+func parseReadMode(name string) (mgo.Mode, error) {
+	mode, ok := readModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown read mode %s", name)
+	}
+	return mode, nil
+}
+
+// parseWriteConcern parses a write concern of the form w[:j][:wtimeout], w
+// being a number of nodes, majority or a tag set, and 0 fire-and-forget, for
+// which it returns nil as mgo.Session.SetSafe expects.
+func parseWriteConcern(spec string) (*mgo.Safe, error) {
+	parts := strings.Split(spec, ":")
+	if parts[0] == "0" {
+		if len(parts) > 1 {
+			return nil, fmt.Errorf("write concern %s: fire-and-forget takes no j or wtimeout", spec)
+		}
+		return nil, nil
+	}
+	safe := &mgo.Safe{}
+	if n, err := strconv.Atoi(parts[0]); err == nil {
+		safe.W = n
+	} else {
+		safe.WMode = parts[0]
+	}
+	for _, part := range parts[1:] {
+		if part == "j" {
+			safe.J = true
+			continue
+		}
+		timeout, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, fmt.Errorf("write concern %s: %s is neither j nor a wtimeout", spec, part)
+		}
+		safe.WTimeout = int(timeout / time.Millisecond)
+	}
+	return safe, nil
 }
 
 func main() {
@@ -134,6 +530,14 @@ func main() {
 	coll := flag.String("coll", "coll", "collection")
 	listenAddr := flag.String("listen", ":9876", "server listen addr")
 	sessionCount := flag.Int("session-count", 10, "Mongodb Session Count for each addr")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "max time to wait for the requests in flight on SIGINT or SIGTERM")
+	backend := flag.String("backend", "mongo", "storage backend, mongo or memory")
+	ensureIndexes := flag.Bool("ensure-indexes", false, "ensure indexes on key0 ~ key19 at startup")
+	writeW := flag.String("w", "", "write concern, a number of nodes, majority or a tag set, 0 means fire-and-forget, empty keeps the mgo default")
+	journal := flag.Bool("j", false, "write concern waits for the journal")
+	wtimeout := flag.Duration("wtimeout", 0, "write concern timeout, 0 means none")
+	readMode := flag.String("read-mode", "Strong", "mgo consistency mode of the sessions, Primary, PrimaryPreferred, Secondary, SecondaryPreferred, Nearest, Eventual, Monotonic or Strong, overridden by the X-Mongo-Read-Mode header of a request")
+	indexKeys := flag.String("index-keys", "", "comma separated keys, dotted for nested ones, indexed by -ensure-indexes instead of key0 ~ key19")
 	verbose := flag.Bool("verbose", false, "verbose mode")
 	debug := flag.Bool("debug", false, "debug mode")
 	flag.Parse()
@@ -145,23 +549,97 @@ func main() {
 		mgo.SetDebug(*debug)
 	}
 
-	addrs := strings.Split(*mgoAddrs, ",")
 	server := &Server{
 		verbose: *verbose,
 		debug:   *debug,
-		colls:   make([]*mgo.Collection, (*sessionCount)*len(addrs)),
 	}
 
-	for i := 0; i < (*sessionCount)*len(addrs); i++ {
-		s, err := mgo.Dial(addrs[i%len(addrs)])
+	switch *backend {
+	case "mongo":
+		concern := *writeW
+		if *journal {
+			concern += ":j"
+		}
+		if *wtimeout > 0 {
+			concern += ":" + wtimeout.String()
+		}
+		safe, err := parseWriteConcern(concern)
+		if concern != "" && err != nil {
+			log.Fatal(err)
+		}
+		mode, err := parseReadMode(*readMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		addrs := strings.Split(*mgoAddrs, ",")
+		store := &MgoStore{
+			colls: make([]*mgo.Collection, (*sessionCount)*len(addrs)),
+			modes: &modeStores{stores: make(map[mgo.Mode]*MgoStore)},
+		}
+		defer store.closeModes()
+		for i := 0; i < (*sessionCount)*len(addrs); i++ {
+			s, err := mgo.Dial(addrs[i%len(addrs)])
+			if err != nil {
+				log.Fatal(err)
+			}
+			s.SetPoolLimit(1048560)
+			s.SetMode(mode, true)
+			if concern != "" {
+				s.SetSafe(safe)
+			}
+			defer s.Close()
+			store.colls[i] = s.DB(*db).C(*coll)
+		}
+		server.store = store
+	case "memory":
+		server.store = NewMemoryStore()
+	default:
+		log.Fatalf("Unknown backend %s\n", *backend)
+	}
+
+	if *ensureIndexes {
+		keys := make([]string, 20)
+		for i := 0; i < 20; i++ {
+			keys[i] = "key" + strconv.Itoa(i)
+		}
+		if *indexKeys != "" {
+			keys = strings.Split(*indexKeys, ",")
+		}
+		err := server.store.EnsureIndexes(keys)
 		if err != nil {
 			log.Fatal(err)
 		}
-		s.SetPoolLimit(1048560)
-		defer s.Close()
-		server.colls[i] = s.DB(*db).C(*coll)
+	}
+	if *verbose {
+		n, err := server.store.Count(nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println(n, "documents in", *backend, "backend")
 	}
 
+	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/", server.Root)
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+
+	// on SIGINT or SIGTERM, stop accepting and let the requests in flight
+	// finish before the Mongo sessions are closed
+	httpServer := &http.Server{Addr: *listenAddr}
+	closed := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Got %s, shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Println("Shutdown failed", err)
+		}
+		close(closed)
+	}()
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-closed
 }
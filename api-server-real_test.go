@@ -0,0 +1,86 @@
+// Run with go test api-server-real.go api-server-real_test.go, every program
+// of this directory is its own main package.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func memoryDocs(t *testing.T) []Doc {
+	var docs []Doc
+	err := json.Unmarshal([]byte(`[
+		{"_id": "a", "key0": "aa", "user": {"age": 30, "name": "x"}},
+		{"_id": "b", "key0": "bb", "user": {"age": 40, "name": "x"}},
+		{"_id": "c", "key0": "cc", "tags": ["t1", "t2"]}
+	]`), &docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return docs
+}
+
+func TestMemoryStoreMatching(t *testing.T) {
+	tests := []struct {
+		query string
+		count int
+	}{
+		{`{"key0": "aa"}`, 1},
+		{`{"key0": "zz"}`, 0},
+		{`{"user.name": "x"}`, 2},
+		{`{"user.name": "x", "user.age": 40}`, 1},
+		{`{"user.name": "x", "key0": "cc"}`, 0},
+		{`{"user.age.value": 30}`, 0},
+		{`{"tags": ["t1", "t2"]}`, 1},
+		{`{"tags": ["t2", "t1"]}`, 0},
+		{`{}`, 3},
+	}
+
+	// indexes built before and after the inserts find the same documents as
+	// a scan
+	for _, mode := range []string{"scan", "indexed before", "indexed after"} {
+		store := NewMemoryStore()
+		keys := []string{"key0", "user.age", "tags"}
+		if mode == "indexed before" {
+			store.EnsureIndexes(keys)
+		}
+		for _, doc := range memoryDocs(t) {
+			store.Insert(doc)
+		}
+		if mode == "indexed after" {
+			store.EnsureIndexes(keys)
+		}
+
+		for _, test := range tests {
+			var query Doc
+			if err := json.Unmarshal([]byte(test.query), &query); err != nil {
+				t.Fatal(err)
+			}
+			n, err := store.Count(query)
+			if err != nil || n != test.count {
+				t.Errorf("%s: Count(%s) = %d, %v, want %d", mode, test.query, n, err, test.count)
+			}
+			doc, err := store.FindOne(query)
+			switch {
+			case test.count == 0 && err != ErrNotFound:
+				t.Errorf("%s: FindOne(%s) = %v, %v, want ErrNotFound", mode, test.query, doc, err)
+			case test.count > 0 && (err != nil || !matches(doc, query)):
+				t.Errorf("%s: FindOne(%s) = %v, %v, want a match", mode, test.query, doc, err)
+			}
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	doc := memoryDocs(t)[0]
+	if v := lookup(doc, "user.name"); v != "x" {
+		t.Errorf("lookup(user.name) = %v, want x", v)
+	}
+	if v := lookup(doc, "user.missing"); v != nil {
+		t.Errorf("lookup(user.missing) = %v, want nil", v)
+	}
+	if v := lookup(doc, "key0.sub"); v != nil {
+		t.Errorf("lookup(key0.sub) = %v, want nil", v)
+	}
+}
@@ -1,22 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
 	murmur3 "github.com/spaolacci/murmur3"
 	mgo "gopkg.in/mgo.v2"
 	bson "gopkg.in/mgo.v2/bson"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func generateMurmur3() []byte {
@@ -69,7 +75,177 @@ func generateRandomHexes() [20]string {
 	}
 }
 
-type Doc map[string]string
+// Schema describes the documents generated from -schema.
+type Schema struct {
+	Fields  []*Field `yaml:"fields"`
+	indexes []string
+	fields  map[string]*Field
+	source  string
+}
+
+type Field struct {
+	Name   string   `yaml:"name"`
+	Type   string   `yaml:"type"`
+	Count  int      `yaml:"count"`
+	Min    int64    `yaml:"min"`
+	Max    int64    `yaml:"max"`
+	Index  bool     `yaml:"index"`
+	Fields []*Field `yaml:"fields"`
+	Items  *Field   `yaml:"items"`
+}
+
+var dateBase = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func loadSchema(path string) *Schema {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var schema Schema
+	err = yaml.Unmarshal(body, &schema)
+	if err != nil {
+		log.Fatalf("Parse schema %s failed: %s\n", path, err)
+	}
+	if len(schema.Fields) == 0 {
+		log.Fatalf("No field in schema %s\n", path)
+	}
+	for _, f := range schema.Fields {
+		if err = f.check(); err != nil {
+			log.Fatalf("Invalid schema %s: %s\n", path, err)
+		}
+	}
+	schema.source = string(body)
+	schema.fields = make(map[string]*Field)
+	schema.addIndexes("", schema.Fields)
+	if len(schema.indexes) == 0 {
+		log.Fatalf("No indexed field to query in schema %s\n", path)
+	}
+	return &schema
+}
+
+func (f *Field) check() error {
+	if f.Name == "" {
+		return fmt.Errorf("field without name")
+	}
+	if f.Count < 0 || f.Min < 0 || f.Max < f.Min {
+		return fmt.Errorf("invalid count or bounds of field %s", f.Name)
+	}
+	defaults := func(min, max int64) {
+		if f.Min == 0 && f.Max == 0 {
+			f.Min, f.Max = min, max
+		}
+	}
+	switch f.Type {
+	case "string":
+		defaults(32, 32)
+	case "int":
+		defaults(0, math.MaxInt32)
+	case "date":
+		defaults(0, 365*24*3600)
+	case "nested":
+		if len(f.Fields) == 0 {
+			return fmt.Errorf("nested field %s without fields", f.Name)
+		}
+		for _, child := range f.Fields {
+			if err := child.check(); err != nil {
+				return err
+			}
+		}
+	case "array":
+		if f.Items == nil {
+			return fmt.Errorf("array field %s without items", f.Name)
+		}
+		if f.Items.Name == "" {
+			f.Items.Name = f.Name
+		}
+		defaults(1, 5)
+		return f.Items.check()
+	default:
+		return fmt.Errorf("unknown type %q of field %s", f.Type, f.Name)
+	}
+	return nil
+}
+
+func (f *Field) names() []string {
+	if f.Count == 0 {
+		return []string{f.Name}
+	}
+	names := make([]string, f.Count)
+	for i := range names {
+		names[i] = f.Name + strconv.Itoa(i)
+	}
+	return names
+}
+
+func (s *Schema) addIndexes(prefix string, fields []*Field) {
+	for _, f := range fields {
+		for _, name := range f.names() {
+			if f.Index {
+				s.indexes = append(s.indexes, prefix+name)
+				s.fields[prefix+name] = f
+			}
+			if f.Type == "nested" {
+				s.addIndexes(prefix+name+".", f.Fields)
+			}
+		}
+	}
+}
+
+func (s *Schema) Generate(key string) map[string]interface{} {
+	rnd := rand.New(rand.NewSource(int64(murmur3.Sum64([]byte(key)))))
+	return generateFields(rnd, s.Fields)
+}
+
+func generateFields(rnd *rand.Rand, fields []*Field) map[string]interface{} {
+	doc := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		for _, name := range f.names() {
+			doc[name] = f.generate(rnd)
+		}
+	}
+	return doc
+}
+
+func (f *Field) generate(rnd *rand.Rand) interface{} {
+	n := f.Min + rnd.Int63n(f.Max-f.Min+1)
+	switch f.Type {
+	case "string":
+		b := make([]byte, (n+1)/2)
+		rnd.Read(b)
+		return hex.EncodeToString(b)[:n]
+	case "int":
+		return n
+	case "date":
+		return dateBase.Add(time.Duration(n) * time.Second)
+	case "nested":
+		return generateFields(rnd, f.Fields)
+	case "array":
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = f.Items.generate(rnd)
+		}
+		return items
+	}
+	return nil
+}
+
+// lookup returns the value at the dotted path of doc, nil if there is none.
+func lookup(doc map[string]interface{}, path string) interface{} {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		switch m := value.(type) {
+		case map[string]interface{}:
+			value = m[name]
+		case bson.M:
+			value = m[name]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+type Doc map[string]interface{}
 
 type Server struct {
 	debug   bool
@@ -77,6 +253,8 @@ type Server struct {
 	idx     uint32
 	colls   []*mgo.Collection
 	samples []Doc
+	// schema, if set, describes the inserted documents instead of 20 hex keys.
+	schema *Schema
 }
 
 func (s *Server) Root(w http.ResponseWriter, r *http.Request) {
@@ -124,8 +302,12 @@ func (s *Server) find(w http.ResponseWriter, r *http.Request) {
 func (s *Server) insert(w http.ResponseWriter, r *http.Request) {
 	doc := Doc{}
 	hexes := generateRandomHexes()
-	for i := 0; i < 20; i++ {
-		doc[fmt.Sprintf("key%v", i)] = hexes[i]
+	if s.schema != nil {
+		doc = s.schema.Generate(hexes[0])
+	} else {
+		for i := 0; i < 20; i++ {
+			doc[fmt.Sprintf("key%v", i)] = hexes[i]
+		}
 	}
 	err := s.getCollection().Insert(doc)
 	if err != nil {
@@ -139,8 +321,16 @@ func (s *Server) insert(w http.ResponseWriter, r *http.Request) {
 func (s *Server) createSamples(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
 
+	keys := make([]string, 20)
 	for i := 0; i < 20; i++ {
-		err := s.getCollection().EnsureIndexKey("key" + strconv.Itoa(i))
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	if s.schema != nil {
+		keys = s.schema.indexes
+	}
+
+	for _, key := range keys {
+		err := s.getCollection().EnsureIndexKey(key)
 		if err != nil {
 			log.Println("Failed to ensure index", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -168,8 +358,8 @@ func (s *Server) createSamples(w http.ResponseWriter, r *http.Request) {
 		for i, result := range results {
 			sample := make(Doc)
 			for j := 0; j < rand.Intn(5); j++ {
-				key := "key" + strconv.Itoa(rand.Intn(20))
-				sample[key] = result[key]
+				key := keys[rand.Intn(len(keys))]
+				sample[key] = lookup(result, key)
 			}
 			s.samples[i] = sample
 		}
@@ -182,12 +372,36 @@ func (s *Server) getCollection() *mgo.Collection {
 	return s.colls[id]
 }
 
+// readModes are the mgo consistency modes by their lowercase names.
+var readModes = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primarypreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondarypreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+	"eventual":           mgo.Eventual,
+	"monotonic":          mgo.Monotonic,
+	"strong":             mgo.Strong,
+}
+
+// parseReadMode returns the mgo mode named name, in any case.
+func parseReadMode(name string) (mgo.Mode, error) {
+	mode, ok := readModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown read mode %s", name)
+	}
+	return mode, nil
+}
+
 func main() {
 	mgoAddrs := flag.String("addrs", "127.0.0.1", "mongodb addrs")
 	db := flag.String("db", "poc-go", "db")
 	coll := flag.String("coll", "coll", "collection")
 	listenAddr := flag.String("listen", ":9876", "server listen addr")
 	sessionCount := flag.Int("session-count", 10, "Mongodb Session Count for each addr")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "max time to wait for the requests in flight on SIGINT or SIGTERM")
+	readMode := flag.String("read-mode", "Strong", "mgo consistency mode of the sessions, Primary, PrimaryPreferred, Secondary, SecondaryPreferred, Nearest, Eventual, Monotonic or Strong")
+	schemaPath := flag.String("schema", "", "insert the documents described by this YAML or JSON schema file instead of 20 hex keys")
 	verbose := flag.Bool("verbose", false, "verbose mode")
 	debug := flag.Bool("debug", false, "debug mode")
 	flag.Parse()
@@ -199,12 +413,20 @@ func main() {
 		mgo.SetDebug(*debug)
 	}
 
+	mode, err := parseReadMode(*readMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	addrs := strings.Split(*mgoAddrs, ",")
 	server := &Server{
 		verbose: *verbose,
 		debug:   *debug,
 		colls:   make([]*mgo.Collection, (*sessionCount)*len(addrs)),
 	}
+	if *schemaPath != "" {
+		server.schema = loadSchema(*schemaPath)
+	}
 
 	for i := 0; i < (*sessionCount)*len(addrs); i++ {
 		s, err := mgo.Dial(addrs[i%len(addrs)])
@@ -212,10 +434,31 @@ func main() {
 			log.Fatal(err)
 		}
 		s.SetPoolLimit(1048560)
+		s.SetMode(mode, true)
 		defer s.Close()
 		server.colls[i] = s.DB(*db).C(*coll)
 	}
 
 	http.HandleFunc("/", server.Root)
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+
+	// on SIGINT or SIGTERM, stop accepting and let the requests in flight
+	// finish before the Mongo sessions are closed
+	httpServer := &http.Server{Addr: *listenAddr}
+	closed := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Got %s, shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Println("Shutdown failed", err)
+		}
+		close(closed)
+	}()
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-closed
 }
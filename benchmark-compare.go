@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
+)
+
+var (
+	threshold = flag.Float64("threshold", 5, "percentage of change beyond which a significant change is a regression, in points for the error ratio")
+	alpha     = flag.Float64("alpha", 0.05, "significance level of the statistical tests")
+)
+
+// Result mirrors the documents written by -result-json of api-benchmark-real
+// and mongo-benchmark.
+type Result struct {
+	Program string            `json:"program"`
+	Start   time.Time         `json:"start"`
+	Flags   map[string]string `json:"flags"`
+	Ops     []*OpResult       `json:"ops"`
+}
+
+type OpResult struct {
+	Phase     string             `json:"phase"`
+	Op        string             `json:"op"`
+	Count     int64              `json:"count"`
+	Elapsed   float64            `json:"elapsed_seconds"`
+	Rate      float64            `json:"rate"`
+	Latency   map[string]float64 `json:"latency_ms"`
+	Errors    map[int]uint64     `json:"errors"`
+	Intervals []Interval         `json:"intervals"`
+	Histogram string             `json:"histogram"`
+}
+
+type Interval struct {
+	End   float64 `json:"end_seconds"`
+	Count uint64  `json:"count"`
+	Rate  float64 `json:"rate"`
+}
+
+var percentiles = []string{"p50", "p90", "p99", "p99.9", "max"}
+
+func loadResult(path string) *Result {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var result Result
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		log.Fatalf("Parse %s failed: %s\n", path, err)
+	}
+	return &result
+}
+
+func (r *Result) find(phase, op string) *OpResult {
+	for _, o := range r.Ops {
+		if o.Phase == phase && o.Op == op {
+			return o
+		}
+	}
+	return nil
+}
+
+// steadyRates returns the throughput of the intervals which lie inside the
+// measurement window, leaving out warmup, cooldown and a partial last interval.
+func (r *Result) steadyRates(o *OpResult) []float64 {
+	warmup, _ := time.ParseDuration(r.Flags["warmup"])
+	duration, _ := time.ParseDuration(r.Flags["duration"])
+	interval, _ := time.ParseDuration(r.Flags["interval"])
+
+	intervals := o.Intervals
+	if duration == 0 && len(intervals) > 0 {
+		intervals = intervals[:len(intervals)-1]
+	}
+	var rates []float64
+	for _, i := range intervals {
+		if i.End-interval.Seconds() < warmup.Seconds() {
+			continue
+		}
+		if duration > 0 && i.End > (warmup+duration).Seconds() {
+			continue
+		}
+		rates = append(rates, i.Rate)
+	}
+	return rates
+}
+
+func normalCDF(z float64) float64 {
+	return 0.5 * math.Erfc(-z/math.Sqrt2)
+}
+
+// mannWhitney returns the one-sided p-value of candidate latencies being
+// greater than baseline latencies, using the normal approximation of the
+// Mann-Whitney U test over the histogram buckets.
+func mannWhitney(baseline, candidate *hdrhistogram.Histogram) float64 {
+	nb := float64(baseline.TotalCount())
+	nc := float64(candidate.TotalCount())
+	if nb == 0 || nc == 0 {
+		return 1
+	}
+
+	base := baseline.Distribution()
+	cand := candidate.Distribution()
+	u, below, ties := 0.0, 0.0, 0.0
+	for i, j := 0, 0; i < len(base) || j < len(cand); {
+		var b, c int64
+		switch {
+		case j >= len(cand) || (i < len(base) && base[i].From < cand[j].From):
+			b = base[i].Count
+			i++
+		case i >= len(base) || cand[j].From < base[i].From:
+			c = cand[j].Count
+			j++
+		default:
+			b, c = base[i].Count, cand[j].Count
+			i++
+			j++
+		}
+		u += float64(c) * (below + float64(b)/2)
+		below += float64(b)
+		t := float64(b + c)
+		ties += t*t*t - t
+	}
+
+	n := nb + nc
+	variance := nb * nc / 12 * ((n + 1) - ties/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	return 1 - normalCDF((u-nb*nc/2)/math.Sqrt(variance))
+}
+
+// welch returns the one-sided p-value of the candidate mean being lower than
+// the baseline mean with Welch's t-test.
+func welch(baseline, candidate []float64) float64 {
+	if len(baseline) < 2 || len(candidate) < 2 {
+		return math.NaN()
+	}
+	mb, vb := meanVariance(baseline)
+	mc, vc := meanVariance(candidate)
+	sb := vb / float64(len(baseline))
+	sc := vc / float64(len(candidate))
+	if sb+sc == 0 {
+		if mc < mb {
+			return 0
+		}
+		return 1
+	}
+	t := (mb - mc) / math.Sqrt(sb+sc)
+	df := (sb + sc) * (sb + sc) / (sb*sb/float64(len(baseline)-1) + sc*sc/float64(len(candidate)-1))
+	return 1 - studentCDF(t, df)
+}
+
+func meanVariance(xs []float64) (float64, float64) {
+	mean := 0.0
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	variance := 0.0
+	for _, x := range xs {
+		variance += (x - mean) * (x - mean)
+	}
+	return mean, variance / float64(len(xs)-1)
+}
+
+func studentCDF(t, df float64) float64 {
+	p := 0.5 * incompleteBeta(df/2, 0.5, df/(df+t*t))
+	if t > 0 {
+		return 1 - p
+	}
+	return p
+}
+
+// incompleteBeta is the regularized incomplete beta function I_x(a, b).
+func incompleteBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a + b)
+	lb, _ := math.Lgamma(a)
+	lc, _ := math.Lgamma(b)
+	front := math.Exp(la - lb - lc + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaFraction(a, b, x) / a
+	}
+	return 1 - front*betaFraction(b, a, 1-x)/b
+}
+
+// betaFraction evaluates the continued fraction of the incomplete beta
+// function with the modified Lentz's method.
+func betaFraction(a, b, x float64) float64 {
+	const tiny = 1e-30
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1.0; m <= 300; m++ {
+		for _, num := range []float64{
+			m * (b - m) * x / ((a + 2*m - 1) * (a + 2*m)),
+			-(a + m) * (a + b + m) * x / ((a + 2*m) * (a + 2*m + 1)),
+		} {
+			d = 1 + num*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+		}
+		if math.Abs(d*c-1) < 1e-12 {
+			break
+		}
+	}
+	return h
+}
+
+func percent(from, to float64) float64 {
+	if from == 0 {
+		return 0
+	}
+	return (to - from) / from * 100
+}
+
+// errorRatio returns the share of errors among the count operations and the
+// errors.
+func errorRatio(count int64, errors uint64) float64 {
+	if count <= 0 && errors == 0 {
+		return 0
+	}
+	return float64(errors) / (float64(count) + float64(errors))
+}
+
+// compare prints the deltas of candidate against baseline and returns the
+// number of regressions.
+func compare(baseline, candidate *Result) int {
+	regressions := 0
+	for _, b := range baseline.Ops {
+		c := candidate.find(b.Phase, b.Op)
+		if c == nil {
+			fmt.Printf("%s %s: missing in candidate\n", b.Phase, b.Op)
+			continue
+		}
+
+		p := welch(baseline.steadyRates(b), candidate.steadyRates(c))
+		delta := percent(b.Rate, c.Rate)
+		mark := ""
+		if -delta > *threshold && (math.IsNaN(p) || p < *alpha) {
+			mark = " REGRESSION"
+			regressions++
+		}
+		fmt.Printf("%s %s rate %.1f/s -> %.1f/s %+.2f%% p=%.4f%s\n", b.Phase, b.Op, b.Rate, c.Rate, delta, p, mark)
+
+		p = math.NaN()
+		bh, errB := hdrhistogram.Decode([]byte(b.Histogram))
+		ch, errC := hdrhistogram.Decode([]byte(c.Histogram))
+		if errB == nil && errC == nil {
+			p = mannWhitney(bh, ch)
+		}
+		for _, name := range percentiles {
+			delta := percent(b.Latency[name], c.Latency[name])
+			mark := ""
+			if delta > *threshold && (math.IsNaN(p) || p < *alpha) {
+				mark = " REGRESSION"
+				regressions++
+			}
+			fmt.Printf("%s %s %s %.3fms -> %.3fms %+.2f%% p=%.4f%s\n", b.Phase, b.Op, name, b.Latency[name], c.Latency[name], delta, p, mark)
+		}
+
+		var be, ce uint64
+		for _, n := range b.Errors {
+			be += n
+		}
+		for _, n := range c.Errors {
+			ce += n
+		}
+		if be > 0 || ce > 0 {
+			// the ratios are compared in percentage points, there is no
+			// relative change from no errors
+			delta := (errorRatio(c.Count, ce) - errorRatio(b.Count, be)) * 100
+			mark := ""
+			if delta > *threshold {
+				mark = " REGRESSION"
+				regressions++
+			}
+			fmt.Printf("%s %s errors %d -> %d %+.2f points%s\n", b.Phase, b.Op, be, ce, delta, mark)
+		}
+	}
+	return regressions
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] baseline.json candidate.json [candidate.json ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	baseline := loadResult(flag.Arg(0))
+	regressions := 0
+	for _, path := range flag.Args()[1:] {
+		candidate := loadResult(path)
+		if candidate.Program != baseline.Program {
+			log.Printf("Comparing %s result %s with %s result %s\n", candidate.Program, path, baseline.Program, flag.Arg(0))
+		}
+		fmt.Printf("== %s vs %s\n", flag.Arg(0), path)
+		regressions += compare(baseline, candidate)
+	}
+	if regressions > 0 {
+		fmt.Printf("%d regressions found\n", regressions)
+		os.Exit(1)
+	}
+}
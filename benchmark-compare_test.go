@@ -0,0 +1,89 @@
+// Run with go test benchmark-compare.go benchmark-compare_test.go, every
+// program of this directory is its own main package.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
+)
+
+func latencies(rnd *rand.Rand, n int, mean float64) *hdrhistogram.Histogram {
+	h := hdrhistogram.New(1, 3600000000, 3)
+	for i := 0; i < n; i++ {
+		h.RecordValue(int64(mean + rnd.NormFloat64()*mean/10))
+	}
+	return h
+}
+
+func TestMannWhitney(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	base := latencies(rnd, 2000, 1000)
+
+	if p := mannWhitney(base, base); math.Abs(p-0.5) > 0.01 {
+		t.Errorf("same latencies: p = %v, want 0.5", p)
+	}
+	if p := mannWhitney(base, latencies(rnd, 2000, 1100)); p > 0.001 {
+		t.Errorf("slower candidate: p = %v, want about 0", p)
+	}
+	if p := mannWhitney(base, latencies(rnd, 2000, 900)); p < 0.999 {
+		t.Errorf("faster candidate: p = %v, want about 1", p)
+	}
+	if p := mannWhitney(base, latencies(rnd, 2000, 1000)); p < *alpha {
+		t.Errorf("same distribution: p = %v, want above %v", p, *alpha)
+	}
+	empty := hdrhistogram.New(1, 3600000000, 3)
+	if p := mannWhitney(empty, base); p != 1 {
+		t.Errorf("empty baseline: p = %v, want 1", p)
+	}
+}
+
+func TestWelch(t *testing.T) {
+	base := []float64{100, 102, 98, 101, 99, 100}
+	tests := []struct {
+		name      string
+		candidate []float64
+		min, max  float64
+	}{
+		{"same", []float64{100, 102, 98, 101, 99, 100}, 0.49, 0.51},
+		{"lower", []float64{90, 92, 88, 91, 89, 90}, 0, 0.001},
+		{"higher", []float64{110, 112, 108, 111, 109, 110}, 0.999, 1},
+		{"constant lower", []float64{90, 90}, 0, 0.001},
+	}
+	for _, test := range tests {
+		if p := welch(base, test.candidate); p < test.min || p > test.max {
+			t.Errorf("%s: p = %v, want in [%v, %v]", test.name, p, test.min, test.max)
+		}
+	}
+
+	if p := welch([]float64{5, 5}, []float64{4, 4}); p != 0 {
+		t.Errorf("no variance, lower: p = %v, want 0", p)
+	}
+	if p := welch([]float64{5, 5}, []float64{5, 5}); p != 1 {
+		t.Errorf("no variance, same: p = %v, want 1", p)
+	}
+	if p := welch([]float64{5}, base); !math.IsNaN(p) {
+		t.Errorf("single interval: p = %v, want NaN", p)
+	}
+}
+
+func TestErrorRatio(t *testing.T) {
+	tests := []struct {
+		count  int64
+		errors uint64
+		want   float64
+	}{
+		{0, 0, 0},
+		{100, 0, 0},
+		{0, 10, 1},
+		{90, 10, 0.1},
+	}
+	for _, test := range tests {
+		if got := errorRatio(test.count, test.errors); got != test.want {
+			t.Errorf("errorRatio(%d, %d) = %v, want %v", test.count, test.errors, got, test.want)
+		}
+	}
+}
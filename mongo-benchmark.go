@@ -1,160 +1,1865 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"os"
+	"os/signal"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/pborman/uuid"
 	murmur3 "github.com/spaolacci/murmur3"
 	mgo "gopkg.in/mgo.v2"
 	bson "gopkg.in/mgo.v2/bson"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
-	NumberGoroutine   = flag.Int("n", 1, "number of goruntine")
-	host              = flag.String("h", "127.0.0.1", "host")
-	db                = flag.String("d", "test", "db")
-	coll              = flag.String("c", "test", "coll")
-	dbCount           = flag.Int("dbs", 1, "db count")
-	writeCount        = flag.Uint64("qw", 0, "number of write")
-	queryCount        = flag.Uint64("qr", 0, "number of query")
-	frequency         = flag.Uint64("frequency", 100000, "benchmark frequency")
-	verbose           = flag.Bool("verbose", false, "verbose")
-	debug             = flag.Bool("debug", false, "debug")
-	samplePath        = flag.String("sample-path", "samplefile.data", "Record all generated sample")
-	sampleFile        *os.File
-	totalWrite        = uint64(0)
-	totalQuery        = uint64(0)
-	last              time.Time
-	collsList         [][]*mgo.Collection
-	sampleFileContent []byte
+	NumberGoroutine = flag.Int("n", 1, "number of goruntine")
+	host            = flag.String("h", "127.0.0.1", "host")
+	db              = flag.String("d", "test", "db")
+	coll            = flag.String("c", "test", "coll")
+	dbCount         = flag.Int("dbs", 1, "number of databases -d_0 ~ -d_N-1 the documents are spread over by a hash of their key")
+	batchSize       = flag.Int("batch-size", 1, "number of documents of each insert, more than 1 inserts them with a Bulk per partition")
+	unordered       = flag.Bool("unordered", false, "run the Bulk inserts of -batch-size unordered, so a failed document doesn't skip the ones after it")
+	writeW          = flag.String("w", "", "write concern, a number of nodes, majority or a tag set, 0 means fire-and-forget, empty keeps the mgo default")
+	journal         = flag.Bool("j", false, "write concern waits for the journal")
+	wtimeout        = flag.Duration("wtimeout", 0, "write concern timeout, 0 means none")
+	writeConcerns   = flag.String("write-concerns", "", "comma separated write concerns w[:j][:wtimeout], e.g. 1,majority,majority:j:5s,0, to run the write phase with each on emptied collections and report them apart, requires -drop")
+	dropColls       = flag.Bool("drop", false, "let -write-concerns drop the -d and -c partitions and empty the sample file before each of its runs")
+	readMode        = flag.String("read-mode", "Eventual", "mgo consistency mode of the sessions, Primary, PrimaryPreferred, Secondary, SecondaryPreferred, Nearest, Eventual, Monotonic or Strong")
+	collCount       = flag.Int("colls", 1, "number of collections -c_0 ~ -c_N-1 of each database the documents are spread over by a hash of their key")
+	writeCount      = flag.Uint64("qw", 0, "number of write")
+	queryCount      = flag.Uint64("qr", 0, "number of query")
+	frequency       = flag.Uint64("frequency", 100000, "benchmark frequency")
+	rate            = flag.Float64("rate", 0, "target operations per second of all goroutines, 0 means closed-loop")
+	arrival         = flag.String("arrival", "constant", "arrival of operations in -rate mode, constant or poisson")
+	duration        = flag.Duration("duration", 0, "measured length of each phase, 0 means bounded by counts only")
+	warmup          = flag.Duration("warmup", 0, "length of the unrecorded window before measurement")
+	cooldown        = flag.Duration("cooldown", 0, "length of the unrecorded window after -duration")
+	interval        = flag.Duration("interval", time.Second, "sampling interval of the throughput time series")
+	resultJSON      = flag.String("result-json", "", "write the result document of the run to this JSON file")
+	resultCSV       = flag.String("result-csv", "", "write the summary and throughput time series of the run to this CSV file")
+	verbose         = flag.Bool("verbose", false, "verbose")
+	debug           = flag.Bool("debug", false, "debug")
+	samplePath      = flag.String("sample-path", "samplefile.data", "Record all generated sample")
+	seed            = flag.Int64("seed", 0, "seed of the generated documents and queries of every worker, 0 means a random one; the queries of scenarios also depend on the keys written so far")
+	missRatio       = flag.Float64("miss-ratio", 0, "fraction of queries for keys known not to exist, reported apart from hits")
+	distribution    = flag.String("distribution", "uniform", "distribution of queried sample records, uniform, zipfian, latest or hotspot")
+	zipfTheta       = flag.Float64("zipf-theta", 0.99, "skew of the zipfian and latest distributions, in (0, 1)")
+	hotFraction     = flag.Float64("hot-fraction", 0.2, "fraction of sample records which are hot in the hotspot distribution")
+	hotOps          = flag.Float64("hot-ops", 0.8, "fraction of queries for hot records in the hotspot distribution")
+	schemaPath      = flag.String("schema", "", "generate the documents described by this YAML or JSON schema file instead of 20 hex keys")
+	scenarioPath    = flag.String("scenario", "", "run the phases of this YAML or JSON scenario file instead of -qw and -qr")
+	recentKeysMax   = flag.Int("recent-keys", 1000000, "max number of keys inserted by a scenario kept for queries, 0 keeps none")
+	sampleBatch     = flag.Int("sample-batch", 1024, "number of sample records per write")
+	sampleFlush     = flag.Duration("sample-flush", time.Second, "interval of updating the sample file header")
+	sampleSync      = flag.String("sample-sync", "flush", "when to fsync the sample file, none, flush (every -sample-flush) or close")
+	beforeQuery     = flag.String("before-query", "", "comma separated hooks run in order before the query phase: signal (wait for SIGUSR1), delay (-query-delay), indexes (wait until no index build is in progress) or warmup (query every sample record once)")
+	queryDelay      = flag.Duration("query-delay", 10*time.Second, "wait of the delay hook of -before-query")
+	indexPoll       = flag.Duration("index-poll", 5*time.Second, "interval of checking index builds in the indexes hook of -before-query")
+	querySignal     chan os.Signal
+	recorder        *SampleRecorder
+	totalWrite      = uint64(0)
+	totalQuery      = uint64(0)
+	totalMixed      = uint64(0)
+	workerSeq       = uint64(0)
+	last            = int64(0)
+	phase           *Phase
+	result          *Result
+	pacer           *Pacer
+	setFlags        map[string]bool
+	collsList       [][]*mgo.Collection
+	samples         *SampleReader
+	recentKeys      *KeyPool
+	chooser         Chooser
+	schema          *Schema
+	queryMinKeys    = 1
+	queryMaxKeys    = 5
 )
 
-func generateMurmur3() []byte {
+// newRand returns the random source of the next worker or poisson Pacer. With
+// -seed a worker only depends on the seed and the order workers are started
+// in, so its documents and queries are the same in every run. The queries of
+// scenarios are the exception, they also pick among the keys written so far by
+// all workers, which depends on timing.
+func newRand() *rand.Rand {
+	s := *seed
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[0:], uint64(s))
+	binary.LittleEndian.PutUint64(buf[8:], atomic.AddUint64(&workerSeq, 1))
+	return rand.New(rand.NewSource(int64(murmur3.Sum64(buf[:]))))
+}
+
+// workerQuota returns how many of count operations worker i of n runs. With -seed
+// each worker runs a fixed share, so that the same documents and queries are
+// generated in every run; otherwise workers take operations until count runs
+// out.
+func workerQuota(count uint64, i, n int) uint64 {
+	if *seed == 0 || count == 0 {
+		return math.MaxUint64
+	}
+	q := count / uint64(n)
+	if uint64(i) < count%uint64(n) {
+		q++
+	}
+	return q
+}
+
+// newID returns a random UUID drawn from rnd.
+func newID(rnd *rand.Rand) string {
+	id := make(uuid.UUID, 16)
+	rnd.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id.String()
+}
+
+func generateMurmur3(rnd *rand.Rand) []byte {
 	var bytesArray [16]byte
 
-	lpointer := unsafe.Pointer(&bytesArray[0])
-	hpointer := unsafe.Pointer(&bytesArray[8])
-	*(*int64)(lpointer) = time.Now().UnixNano()
+	lpointer := unsafe.Pointer(&bytesArray[0])
+	hpointer := unsafe.Pointer(&bytesArray[8])
+	*(*uint64)(lpointer) = rnd.Uint64()
+
+	hasher := murmur3.New128()
+	hasher.Write(bytesArray[0:8])
+	r1, r2 := hasher.Sum128()
+
+	*(*uint64)(lpointer) = r1
+	*(*uint64)(hpointer) = r2
+
+	return bytesArray[:]
+}
+
+func generateRandomHexes(rnd *rand.Rand) [20]string {
+	var bytes1 []byte = generateMurmur3(rnd)
+	var bytes2 []byte = generateMurmur3(rnd)
+	var bytes3 []byte = generateMurmur3(rnd)
+	var bytes4 []byte = generateMurmur3(rnd)
+	var hex1 string = hex.EncodeToString(bytes1)
+	var hex2 string = hex.EncodeToString(bytes2)
+	var hex3 string = hex.EncodeToString(bytes3)
+	var hex4 string = hex.EncodeToString(bytes4)
+	return [20]string{
+		strings.Join([]string{hex1, hex2, hex3, hex4}, ""),
+		strings.Join([]string{hex1, hex2, hex4, hex3}, ""),
+		strings.Join([]string{hex1, hex3, hex2, hex4}, ""),
+		strings.Join([]string{hex1, hex3, hex4, hex2}, ""),
+		strings.Join([]string{hex1, hex4, hex2, hex3}, ""),
+		strings.Join([]string{hex1, hex4, hex3, hex2}, ""),
+		strings.Join([]string{hex2, hex1, hex3, hex4}, ""),
+		strings.Join([]string{hex2, hex1, hex4, hex3}, ""),
+		strings.Join([]string{hex2, hex3, hex1, hex4}, ""),
+		strings.Join([]string{hex2, hex3, hex4, hex1}, ""),
+		strings.Join([]string{hex2, hex4, hex3, hex2}, ""),
+		strings.Join([]string{hex2, hex4, hex2, hex3}, ""),
+		strings.Join([]string{hex3, hex1, hex2, hex4}, ""),
+		strings.Join([]string{hex3, hex1, hex4, hex2}, ""),
+		strings.Join([]string{hex3, hex2, hex1, hex4}, ""),
+		strings.Join([]string{hex3, hex2, hex4, hex1}, ""),
+		strings.Join([]string{hex3, hex4, hex1, hex2}, ""),
+		strings.Join([]string{hex3, hex4, hex2, hex1}, ""),
+		strings.Join([]string{hex4, hex1, hex2, hex3}, ""),
+		strings.Join([]string{hex4, hex1, hex3, hex2}, ""),
+	}
+}
+
+// Stats collects the latencies and failures of one operation type.
+// Each worker owns its Stats, they are merged once all workers are done.
+type Stats struct {
+	Latency *hdrhistogram.Histogram
+	// Sampler, if set, counts every completed operation including those
+	// outside the measurement window.
+	Sampler *Sampler
+	// Errors counts failures by MongoDB error code, 0 means the error carries
+	// no code, e.g. a network failure.
+	Errors map[int]uint64
+	// Misses holds the queries for keys known not to exist, nil if there
+	// were none.
+	Misses *Stats
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		Latency: hdrhistogram.New(1, int64(time.Hour/time.Microsecond), 3),
+		Errors:  make(map[int]uint64),
+	}
+}
+
+// Record records the latency of an operation started at start, unless it
+// started outside the measurement window of the current phase.
+func (s *Stats) Record(start time.Time) {
+	if s.Sampler != nil {
+		s.Sampler.Add()
+	}
+	if phase.Measuring(start) {
+		s.Latency.RecordValue(int64(time.Since(start) / time.Microsecond))
+	}
+}
+
+func (s *Stats) RecordError(start time.Time, code int) {
+	if phase.Measuring(start) {
+		s.Errors[code]++
+	}
+}
+
+// MissStats returns the Stats of negative lookups, creating it on first use.
+func (s *Stats) MissStats() *Stats {
+	if s.Misses == nil {
+		s.Misses = NewStats()
+		s.Misses.Sampler = s.Sampler
+	}
+	return s.Misses
+}
+
+func (s *Stats) Merge(other *Stats) {
+	s.Latency.Merge(other.Latency)
+	for code, n := range other.Errors {
+		s.Errors[code] += n
+	}
+	if other.Misses != nil {
+		s.MissStats().Merge(other.Misses)
+	}
+}
+
+func mergeStats(all []*Stats) *Stats {
+	merged := NewStats()
+	for _, s := range all {
+		merged.Merge(s)
+	}
+	return merged
+}
+
+func (s *Stats) Report(op string, elapsed time.Duration) {
+	ms := func(q float64) float64 {
+		return float64(s.Latency.ValueAtQuantile(q)) / 1000
+	}
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(s.Latency.TotalCount()) / elapsed.Seconds()
+	}
+	log.Printf("%s count=%d rate=%.1f/s p50=%.3fms p90=%.3fms p99=%.3fms p99.9=%.3fms max=%.3fms\n",
+		op, s.Latency.TotalCount(), rate, ms(50), ms(90), ms(99), ms(99.9), float64(s.Latency.Max())/1000)
+
+	codes := make([]int, 0, len(s.Errors))
+	for code := range s.Errors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		log.Printf("%s errors code=%d count=%d\n", op, code, s.Errors[code])
+	}
+}
+
+// Sampler counts completed operations and samples the count every -interval
+// to build a throughput time series.
+type Sampler struct {
+	ops       uint64
+	last      time.Time
+	lastOps   uint64
+	start     time.Time
+	intervals []Interval
+	stop      chan bool
+	done      chan bool
+}
+
+func StartSampler() *Sampler {
+	now := time.Now()
+	s := &Sampler{start: now, last: now, stop: make(chan bool), done: make(chan bool)}
+	go s.run()
+	return s
+}
+
+func (s *Sampler) Add() {
+	atomic.AddUint64(&s.ops, 1)
+}
+
+func (s *Sampler) run() {
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sample(now)
+		case <-s.stop:
+			s.sample(time.Now())
+			close(s.done)
+			return
+		}
+	}
+}
+
+func (s *Sampler) sample(now time.Time) {
+	ops := atomic.LoadUint64(&s.ops)
+	s.intervals = append(s.intervals, Interval{
+		End:   now.Sub(s.start).Seconds(),
+		Count: ops - s.lastOps,
+		Rate:  float64(ops-s.lastOps) / now.Sub(s.last).Seconds(),
+	})
+	s.last, s.lastOps = now, ops
+}
+
+// Stop stops sampling and returns the time series.
+func (s *Sampler) Stop() []Interval {
+	close(s.stop)
+	<-s.done
+	return s.intervals
+}
+
+type Interval struct {
+	End   float64 `json:"end_seconds"`
+	Count uint64  `json:"count"`
+	Rate  float64 `json:"rate"`
+}
+
+// Result is the machine-readable outcome of a run, written by -result-json
+// and -result-csv.
+type Result struct {
+	Program string            `json:"program"`
+	Start   time.Time         `json:"start"`
+	Flags   map[string]string `json:"flags"`
+	Ops     []*OpResult       `json:"ops"`
+	// Interrupted is set when a signal stopped the run early, leaving phases
+	// short or skipped.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+type OpResult struct {
+	Phase     string             `json:"phase"`
+	Op        string             `json:"op"`
+	Count     int64              `json:"count"`
+	Elapsed   float64            `json:"elapsed_seconds"`
+	Rate      float64            `json:"rate"`
+	Latency   map[string]float64 `json:"latency_ms"`
+	Errors    map[int]uint64     `json:"errors"`
+	Intervals []Interval         `json:"intervals"`
+	// Histogram is the latency histogram in microseconds in the base64
+	// HdrHistogram V2 compressed encoding.
+	Histogram string `json:"histogram"`
+}
+
+func NewResult(program string) *Result {
+	r := &Result{Program: program, Start: time.Now(), Flags: make(map[string]string)}
+	flag.VisitAll(func(f *flag.Flag) {
+		r.Flags[f.Name] = f.Value.String()
+	})
+	return r
+}
+
+var percentiles = []struct {
+	name     string
+	quantile float64
+}{{"p50", 50}, {"p90", 90}, {"p99", 99}, {"p99.9", 99.9}}
+
+func (r *Result) Add(phaseName, op string, stats *Stats, elapsed time.Duration, intervals []Interval) {
+	opResult := &OpResult{
+		Phase:     phaseName,
+		Op:        op,
+		Count:     stats.Latency.TotalCount(),
+		Elapsed:   elapsed.Seconds(),
+		Latency:   make(map[string]float64),
+		Errors:    stats.Errors,
+		Intervals: intervals,
+	}
+	if encoded, err := stats.Latency.Encode(hdrhistogram.V2CompressedEncodingCookieBase); err == nil {
+		opResult.Histogram = string(encoded)
+	} else {
+		log.Println("Encode histogram failed", err)
+	}
+	if elapsed > 0 {
+		opResult.Rate = float64(opResult.Count) / elapsed.Seconds()
+	}
+	for _, p := range percentiles {
+		opResult.Latency[p.name] = float64(stats.Latency.ValueAtQuantile(p.quantile)) / 1000
+	}
+	opResult.Latency["max"] = float64(stats.Latency.Max()) / 1000
+	opResult.Latency["mean"] = stats.Latency.Mean() / 1000
+	r.Ops = append(r.Ops, opResult)
+}
+
+func (r *Result) WriteJSON(path string) error {
+	body, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, body, 0644)
+}
+
+// WriteCSV writes one summary row per operation followed by one row per
+// interval of its time series, which leaves the latency columns empty.
+func (r *Result) WriteCSV(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	header := []string{"phase", "op", "interval_end_seconds", "count", "rate"}
+	for _, p := range percentiles {
+		header = append(header, p.name+"_ms")
+	}
+	header = append(header, "max_ms", "mean_ms", "errors")
+	w.Write(header)
+
+	for _, op := range r.Ops {
+		errors := uint64(0)
+		for _, n := range op.Errors {
+			errors += n
+		}
+		row := []string{op.Phase, op.Op, "total", strconv.FormatInt(op.Count, 10), formatFloat(op.Rate)}
+		for _, p := range percentiles {
+			row = append(row, formatFloat(op.Latency[p.name]))
+		}
+		row = append(row, formatFloat(op.Latency["max"]), formatFloat(op.Latency["mean"]), strconv.FormatUint(errors, 10))
+		w.Write(row)
+
+		for _, interval := range op.Intervals {
+			row := []string{op.Phase, op.Op, formatFloat(interval.End), strconv.FormatUint(interval.Count, 10), formatFloat(interval.Rate)}
+			for i := 0; i < len(percentiles)+3; i++ {
+				row = append(row, "")
+			}
+			w.Write(row)
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
+
+// report logs the outcome of one operation type of the current phase and
+// adds it to the result document.
+func report(phaseName, op string, stats *Stats, sampler *Sampler) {
+	elapsed := phase.Elapsed()
+	stats.Report(op, elapsed)
+	result.Add(phaseName, op, stats, elapsed, sampler.Stop())
+	if stats.Misses != nil {
+		stats.Misses.Report(op+" miss", elapsed)
+		result.Add(phaseName, op+" miss", stats.Misses, elapsed, nil)
+	}
+}
+
+func writeResult() {
+	result.Interrupted = stopped()
+	if *resultJSON != "" {
+		if err := result.WriteJSON(*resultJSON); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *resultCSV != "" {
+		if err := result.WriteCSV(*resultCSV); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Phase bounds one benchmark phase in time. Operations started during the
+// warmup or cooldown windows are sent but not recorded.
+type Phase struct {
+	measureFrom time.Time
+	measureTo   time.Time
+	end         time.Time
+}
+
+func NewPhase(duration, warmup, cooldown time.Duration) *Phase {
+	p := &Phase{measureFrom: time.Now().Add(warmup)}
+	if duration > 0 {
+		p.measureTo = p.measureFrom.Add(duration)
+		p.end = p.measureTo.Add(cooldown)
+	}
+	return p
+}
+
+// Over reports whether a duration-based phase has finished, or the run has
+// been stopped.
+func (p *Phase) Over() bool {
+	return stopped() || (!p.end.IsZero() && time.Now().After(p.end))
+}
+
+// Measuring reports whether an operation started at t should be recorded.
+func (p *Phase) Measuring(t time.Time) bool {
+	return !t.Before(p.measureFrom) && (p.measureTo.IsZero() || t.Before(p.measureTo))
+}
+
+// Elapsed returns how long the measurement window has lasted so far.
+func (p *Phase) Elapsed() time.Duration {
+	to := time.Now()
+	if !p.measureTo.IsZero() && to.After(p.measureTo) {
+		to = p.measureTo
+	}
+	if to.Before(p.measureFrom) {
+		return 0
+	}
+	return to.Sub(p.measureFrom)
+}
+
+// phaseEnabled reports whether the phase counted by the flag name should run.
+// With -duration, giving the flag at all enables it and 0 means no count limit.
+func phaseEnabled(name string, count uint64) bool {
+	return !stopped() && (count > 0 || (*duration > 0 && setFlags[name]))
+}
+
+// stopping is closed by the first SIGINT or SIGTERM. It ends the current
+// phase and skips the next ones, so the requests in flight drain and the run
+// still records its samples and reports what it has measured. A second signal
+// exits at once.
+var stopping = make(chan struct{})
+
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Got %s, stopping after the requests in flight, again to exit now\n", sig)
+		close(stopping)
+		<-signals
+		os.Exit(1)
+	}()
+}
+
+// stopped reports whether the run has been stopped by a signal.
+func stopped() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pacer hands out the intended start times of an open-loop schedule shared
+// by all workers, so a slow response doesn't delay the requests behind it.
+type Pacer struct {
+	lock     sync.Mutex
+	start    time.Time
+	next     time.Time
+	rateFrom float64
+	rateTo   float64
+	over     time.Duration
+	poisson  bool
+	rnd      *rand.Rand
+}
+
+// NewPacer returns nil when rate is not positive, which means closed-loop.
+func NewPacer(rate float64, arrival string) *Pacer {
+	return NewRampPacer(rate, rate, 0, arrival)
+}
+
+// NewRampPacer changes the rate linearly from rateFrom to rateTo over the
+// given duration and keeps rateTo afterwards.
+func NewRampPacer(rateFrom, rateTo float64, over time.Duration, arrival string) *Pacer {
+	if rateFrom <= 0 && rateTo <= 0 {
+		return nil
+	}
+	now := time.Now()
+	pacer := &Pacer{
+		start:    now,
+		next:     now,
+		rateFrom: rateFrom,
+		rateTo:   rateTo,
+		over:     over,
+	}
+	switch arrival {
+	case "constant":
+	case "poisson":
+		pacer.poisson = true
+		pacer.rnd = newRand()
+	default:
+		log.Fatalf("Unknown arrival %s\n", arrival)
+	}
+	return pacer
+}
+
+// gap returns the mean time between two starts at the current point of the
+// schedule, the rate never goes below one operation per second.
+func (p *Pacer) gap() time.Duration {
+	rate := p.rateTo
+	if elapsed := p.next.Sub(p.start); elapsed < p.over {
+		rate = p.rateFrom + (p.rateTo-p.rateFrom)*float64(elapsed)/float64(p.over)
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// Wait blocks until the next intended start time and returns it. Latency
+// should be measured from the returned time so that queueing behind slow
+// requests is counted. A nil Pacer returns the current time immediately.
+func (p *Pacer) Wait() time.Time {
+	if p == nil {
+		return time.Now()
+	}
+	p.lock.Lock()
+	start := p.next
+	if p.poisson {
+		p.next = p.next.Add(time.Duration(p.rnd.ExpFloat64() * float64(p.gap())))
+	} else {
+		p.next = p.next.Add(p.gap())
+	}
+	p.lock.Unlock()
+
+	if d := start.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+	return start
+}
+
+// errorCode returns the MongoDB error code of err, 0 if it has none.
+func errorCode(err error) int {
+	switch e := err.(type) {
+	case *mgo.LastError:
+		return e.Code
+	case *mgo.QueryError:
+		return e.Code
+	case *mgo.BulkError:
+		if cases := e.Cases(); len(cases) > 0 {
+			return errorCode(cases[0].Err)
+		}
+	}
+	return 0
+}
+
+// parseWriteConcern parses a write concern of the form w[:j][:wtimeout], w
+// being a number of nodes, majority or a tag set, and 0 fire-and-forget, for
+// which it returns nil as mgo.Session.SetSafe expects.
+func parseWriteConcern(spec string) (*mgo.Safe, error) {
+	parts := strings.Split(spec, ":")
+	if parts[0] == "0" {
+		if len(parts) > 1 {
+			return nil, fmt.Errorf("write concern %s: fire-and-forget takes no j or wtimeout", spec)
+		}
+		return nil, nil
+	}
+	safe := &mgo.Safe{}
+	if n, err := strconv.Atoi(parts[0]); err == nil {
+		safe.W = n
+	} else {
+		safe.WMode = parts[0]
+	}
+	for _, part := range parts[1:] {
+		if part == "j" {
+			safe.J = true
+			continue
+		}
+		timeout, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, fmt.Errorf("write concern %s: %s is neither j nor a wtimeout", spec, part)
+		}
+		safe.WTimeout = int(timeout / time.Millisecond)
+	}
+	return safe, nil
+}
+
+// flagWriteConcern returns the write concern of -w, -j and -wtimeout, empty
+// if none is set.
+func flagWriteConcern() string {
+	spec := *writeW
+	if *journal {
+		spec += ":j"
+	}
+	if *wtimeout > 0 {
+		spec += ":" + wtimeout.String()
+	}
+	return spec
+}
+
+// readModes are the mgo consistency modes by their lowercase names.
+var readModes = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primarypreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondarypreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+	"eventual":           mgo.Eventual,
+	"monotonic":          mgo.Monotonic,
+	"strong":             mgo.Strong,
+}
+
+// parseReadMode returns the mgo mode named name, in any case.
+func parseReadMode(name string) (mgo.Mode, error) {
+	mode, ok := readModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown read mode %s", name)
+	}
+	return mode, nil
+}
+
+// skippedInBatch is the error code of the documents after a failure in an
+// ordered Bulk, which are not inserted.
+const skippedInBatch = -1
+
+// wrongResultCount is the error code of the queries which found documents of
+// a key known not to exist, or not the document of an existing one.
+const wrongResultCount = -2
+
+// logThroughput logs the rate of the last frequency operations.
+func logThroughput(op string, t uint64) {
+	now := time.Now().UnixNano()
+	prev := atomic.SwapInt64(&last, now)
+	log.Println(op, t, float64(*frequency)/time.Duration(now-prev).Seconds())
+}
+
+func write(colls []*mgo.Collection, wg *sync.WaitGroup, rnd *rand.Rand, quota uint64, stats *Stats) {
+	var t uint64
+	count := *writeCount
+	for done := uint64(0); done < quota; done++ {
+		if t = atomic.AddUint64(&totalWrite, 1); (count > 0 && t > count) || phase.Over() {
+			break
+		}
+
+		if writeOne(colls, rnd, stats) && t%(*frequency) == 0 {
+			logThroughput("INSERT", t)
+		}
+	}
+	wg.Done()
+}
+
+// writeBulk inserts the documents in Bulks of -batch-size, buffering them
+// per partition until its Bulk is full. It records the latency of every Bulk
+// in batchStats and every document, with the latency of its Bulk, in
+// docStats. quota and -qw count documents, -rate paces Bulks.
+func writeBulk(colls []*mgo.Collection, wg *sync.WaitGroup, rnd *rand.Rand, quota uint64, batchStats, docStats *Stats) {
+	var t uint64
+	count := *writeCount
+	docs := make([][]interface{}, len(colls))
+	records := make([][]map[string]interface{}, len(colls))
+	for done := uint64(0); done < quota; done++ {
+		if t = atomic.AddUint64(&totalWrite, 1); (count > 0 && t > count) || phase.Over() {
+			break
+		}
+
+		doc, record := generateDoc(rnd)
+		p := partition(record)
+		docs[p] = append(docs[p], doc)
+		records[p] = append(records[p], record)
+		if len(docs[p]) == *batchSize {
+			writeBatch(colls[p], rnd, docs[p], records[p], batchStats, docStats)
+			docs[p], records[p] = docs[p][:0], records[p][:0]
+		}
+		if t%(*frequency) == 0 {
+			logThroughput("INSERT", t)
+		}
+	}
+
+	// the last Bulk of each partition isn't full
+	for p, coll := range colls {
+		if len(docs[p]) > 0 {
+			writeBatch(coll, rnd, docs[p], records[p], batchStats, docStats)
+		}
+	}
+	wg.Done()
+}
+
+// writeBatch inserts docs into coll with one Bulk and records the samples of
+// the inserted ones.
+func writeBatch(coll *mgo.Collection, rnd *rand.Rand, docs []interface{}, records []map[string]interface{}, batchStats, docStats *Stats) {
+	bulk := coll.Bulk()
+	if *unordered {
+		bulk.Unordered()
+	}
+	bulk.Insert(docs...)
+
+	start := pacer.Wait()
+	_, err := bulk.Run()
+	batchStats.Record(start)
+	if err != nil {
+		log.Println(err)
+		batchStats.RecordError(start, errorCode(err))
+	}
+	failed := bulkFailures(err, len(docs))
+	for i, record := range records {
+		docStats.Record(start)
+		if code, ok := failed[i]; ok {
+			docStats.RecordError(start, code)
+			continue
+		}
+		recordSample(rnd, record)
+	}
+}
+
+// bulkFailures returns the error codes of the documents of a Bulk which
+// failed with err, by their index in it. Without the index of a failure, as
+// with servers older than 2.6 or network errors, all the documents are taken
+// as failed.
+func bulkFailures(err error, n int) map[int]int {
+	if err == nil {
+		return make(map[int]int)
+	}
+	bulkErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		return bulkCaseFailures([]mgo.BulkErrorCase{{Index: -1, Err: err}}, n, !*unordered)
+	}
+	return bulkCaseFailures(bulkErr.Cases(), n, !*unordered)
+}
+
+// bulkCaseFailures returns the error codes of the documents of a Bulk of n
+// by their index. When ordered, the documents after the first failure are
+// skipped.
+func bulkCaseFailures(cases []mgo.BulkErrorCase, n int, ordered bool) map[int]int {
+	failed := make(map[int]int)
+	first := n
+	for _, c := range cases {
+		if c.Index < 0 {
+			for i := 0; i < n; i++ {
+				failed[i] = errorCode(c.Err)
+			}
+			return failed
+		}
+		failed[c.Index] = errorCode(c.Err)
+		if c.Index < first {
+			first = c.Index
+		}
+	}
+	if ordered {
+		for i := first + 1; i < n; i++ {
+			if _, ok := failed[i]; !ok {
+				failed[i] = skippedInBatch
+			}
+		}
+	}
+	return failed
+}
+
+func writeOne(colls []*mgo.Collection, rnd *rand.Rand, stats *Stats) bool {
+	doc, record := generateDoc(rnd)
+
+	start := pacer.Wait()
+	err := colls[partition(record)].Insert(doc)
+	stats.Record(start)
+	if err != nil {
+		log.Println(err)
+		stats.RecordError(start, errorCode(err))
+		return false
+	}
+
+	recordSample(rnd, record)
+	return true
+}
+
+// generateDoc returns a new document and its sample record.
+func generateDoc(rnd *rand.Rand) (bson.M, map[string]interface{}) {
+	id := newID(rnd)
+	hexes := generateRandomHexes(rnd)
+	doc := bson.M{
+		"_id":   id,
+		"key0":  hexes[0],
+		"key1":  hexes[1],
+		"key2":  hexes[2],
+		"key3":  hexes[3],
+		"key4":  hexes[4],
+		"key5":  hexes[5],
+		"key6":  hexes[6],
+		"key7":  hexes[7],
+		"key8":  hexes[8],
+		"key9":  hexes[9],
+		"key10": hexes[10],
+		"key11": hexes[11],
+		"key12": hexes[12],
+		"key13": hexes[13],
+		"key14": hexes[14],
+		"key15": hexes[15],
+		"key16": hexes[16],
+		"key17": hexes[17],
+		"key18": hexes[18],
+		"key19": hexes[19],
+	}
+	if schema != nil {
+		doc = schema.Generate(hexes[0])
+		doc["_id"] = id
+	}
+	record := map[string]interface{}{"key0": hexes[0]}
+	if schema != nil {
+		record = schema.Record(doc)
+	}
+	return doc, record
+}
+
+// recordSample records the sample record of an inserted document.
+func recordSample(rnd *rand.Rand, record map[string]interface{}) {
+	line, err := json.Marshal(record)
+	if err == nil {
+		err = recorder.Record(line)
+	}
+	if err != nil {
+		log.Println("Record sample failed", err)
+	}
+	if recentKeys != nil {
+		recentKeys.Add(rnd, string(line))
+	}
+}
+
+// Schema describes the documents of -schema, as api-benchmark-real.go does.
+type Schema struct {
+	Fields  []*Field `yaml:"fields"`
+	indexes []string
+	fields  map[string]*Field
+	source  string
+}
+
+type Field struct {
+	Name   string   `yaml:"name"`
+	Type   string   `yaml:"type"`
+	Count  int      `yaml:"count"`
+	Min    int64    `yaml:"min"`
+	Max    int64    `yaml:"max"`
+	Index  bool     `yaml:"index"`
+	Fields []*Field `yaml:"fields"`
+	Items  *Field   `yaml:"items"`
+}
+
+var dateBase = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func loadSchema(path string) *Schema {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var schema Schema
+	err = yaml.Unmarshal(body, &schema)
+	if err != nil {
+		log.Fatalf("Parse schema %s failed: %s\n", path, err)
+	}
+	if len(schema.Fields) == 0 {
+		log.Fatalf("No field in schema %s\n", path)
+	}
+	for _, f := range schema.Fields {
+		if err = f.check(); err != nil {
+			log.Fatalf("Invalid schema %s: %s\n", path, err)
+		}
+	}
+	schema.source = string(body)
+	schema.fields = make(map[string]*Field)
+	schema.addIndexes("", schema.Fields)
+	if len(schema.indexes) == 0 {
+		log.Fatalf("No indexed field to query in schema %s\n", path)
+	}
+	return &schema
+}
+
+func (f *Field) check() error {
+	if f.Name == "" {
+		return fmt.Errorf("field without name")
+	}
+	if f.Count < 0 || f.Min < 0 || f.Max < f.Min {
+		return fmt.Errorf("invalid count or bounds of field %s", f.Name)
+	}
+	defaults := func(min, max int64) {
+		if f.Min == 0 && f.Max == 0 {
+			f.Min, f.Max = min, max
+		}
+	}
+	switch f.Type {
+	case "string":
+		defaults(32, 32)
+	case "int":
+		defaults(0, math.MaxInt32)
+	case "date":
+		defaults(0, 365*24*3600)
+	case "nested":
+		if len(f.Fields) == 0 {
+			return fmt.Errorf("nested field %s without fields", f.Name)
+		}
+		for _, child := range f.Fields {
+			if err := child.check(); err != nil {
+				return err
+			}
+		}
+	case "array":
+		if f.Items == nil {
+			return fmt.Errorf("array field %s without items", f.Name)
+		}
+		if f.Items.Name == "" {
+			f.Items.Name = f.Name
+		}
+		defaults(1, 5)
+		return f.Items.check()
+	default:
+		return fmt.Errorf("unknown type %q of field %s", f.Type, f.Name)
+	}
+	return nil
+}
+
+func (f *Field) names() []string {
+	if f.Count == 0 {
+		return []string{f.Name}
+	}
+	names := make([]string, f.Count)
+	for i := range names {
+		names[i] = f.Name + strconv.Itoa(i)
+	}
+	return names
+}
+
+func (s *Schema) addIndexes(prefix string, fields []*Field) {
+	for _, f := range fields {
+		for _, name := range f.names() {
+			if f.Index {
+				s.indexes = append(s.indexes, prefix+name)
+				s.fields[prefix+name] = f
+			}
+			if f.Type == "nested" {
+				s.addIndexes(prefix+name+".", f.Fields)
+			}
+		}
+	}
+}
+
+func (s *Schema) Generate(key string) map[string]interface{} {
+	rnd := rand.New(rand.NewSource(int64(murmur3.Sum64([]byte(key)))))
+	return generateFields(rnd, s.Fields)
+}
+
+func generateFields(rnd *rand.Rand, fields []*Field) map[string]interface{} {
+	doc := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		for _, name := range f.names() {
+			doc[name] = f.generate(rnd)
+		}
+	}
+	return doc
+}
+
+func (f *Field) generate(rnd *rand.Rand) interface{} {
+	n := f.Min + rnd.Int63n(f.Max-f.Min+1)
+	switch f.Type {
+	case "string":
+		b := make([]byte, (n+1)/2)
+		rnd.Read(b)
+		return hex.EncodeToString(b)[:n]
+	case "int":
+		return n
+	case "date":
+		return dateBase.Add(time.Duration(n) * time.Second)
+	case "nested":
+		return generateFields(rnd, f.Fields)
+	case "array":
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = f.Items.generate(rnd)
+		}
+		return items
+	}
+	return nil
+}
+
+func (s *Schema) MissRecord(rnd *rand.Rand) map[string]interface{} {
+	record := make(map[string]interface{}, len(s.indexes))
+	for _, path := range s.indexes {
+		record[path] = s.fields[path].missing(rnd)
+	}
+	return record
+}
+
+func (f *Field) missing(rnd *rand.Rand) interface{} {
+	switch f.Type {
+	case "string":
+		value := f.generate(rnd).(string)
+		if value == "" {
+			return "x"
+		}
+		return "x" + value[1:]
+	case "int":
+		if f.Max == math.MaxInt64 {
+			return f.Min - 1
+		}
+		return f.Max + 1
+	case "date":
+		return dateBase.Add(-time.Duration(1+rnd.Int63n(f.Max-f.Min+1)) * time.Second)
+	case "nested":
+		doc := make(map[string]interface{}, len(f.Fields))
+		for _, sub := range f.Fields {
+			for _, name := range sub.names() {
+				doc[name] = sub.missing(rnd)
+			}
+		}
+		return doc
+	case "array":
+		return []interface{}{f.Items.missing(rnd)}
+	}
+	return nil
+}
+
+func (s *Schema) Record(doc map[string]interface{}) map[string]interface{} {
+	record := make(map[string]interface{}, len(s.indexes))
+	for _, path := range s.indexes {
+		record[path] = lookup(doc, path)
+	}
+	return record
+}
+
+func (s *Schema) Query(rnd *rand.Rand, record map[string]interface{}, minKeys, maxKeys int) map[string]interface{} {
+	keyCount := minKeys + rnd.Intn(maxKeys-minKeys+1)
+	query := make(map[string]interface{}, keyCount)
+	for i := 0; i < keyCount; i++ {
+		path := s.indexes[rnd.Intn(len(s.indexes))]
+		query[path] = s.typed(path, record[path])
+	}
+	return query
+}
+
+func (s *Schema) typed(path string, value interface{}) interface{} {
+	switch s.fields[path].Type {
+	case "int":
+		if f, ok := value.(float64); ok {
+			return int64(f)
+		}
+	case "date":
+		if str, ok := value.(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, str); err == nil {
+				return t
+			}
+		}
+	}
+	return value
+}
+
+func (s *Schema) recordSize() int64 {
+	size := int64(2)
+	for _, path := range s.indexes {
+		size += int64(len(path)+4) + s.fields[path].maxJSON()
+	}
+	return size + 1
+}
+
+func (f *Field) maxJSON() int64 {
+	switch f.Type {
+	case "string":
+		return f.Max + 2
+	case "int":
+		return 20
+	case "date":
+		return int64(len(`"2006-01-02T15:04:05.999999999Z07:00"`))
+	case "nested":
+		size := int64(2)
+		for _, child := range f.Fields {
+			for _, name := range child.names() {
+				size += int64(len(name)+4) + child.maxJSON()
+			}
+		}
+		return size
+	case "array":
+		return 2 + f.Max*(f.Items.maxJSON()+1)
+	}
+	return 0
+}
+
+// lookup returns the value at the dotted path of doc, nil if there is none.
+func lookup(doc map[string]interface{}, path string) interface{} {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		switch m := value.(type) {
+		case map[string]interface{}:
+			value = m[name]
+		case bson.M:
+			value = m[name]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+const (
+	sampleFormat      = "poc-sample"
+	sampleVersion     = 1
+	defaultRecordSize = 141
+)
+
+// SampleHeader is the first line of a sample file, see api-benchmark-real.go.
+type SampleHeader struct {
+	Format     string   `json:"format"`
+	Version    int      `json:"version"`
+	HeaderSize int64    `json:"header_size"`
+	RecordSize int64    `json:"record_size"`
+	Count      int64    `json:"count"`
+	Seed       int64    `json:"seed"`
+	Schema     string   `json:"schema"`
+	Fields     []string `json:"fields"`
+	Partitions int      `json:"partitions"`
+}
+
+func newSampleHeader(schema *Schema, seed int64) SampleHeader {
+	header := SampleHeader{
+		Format:     sampleFormat,
+		Version:    sampleVersion,
+		RecordSize: defaultRecordSize,
+		Seed:       seed,
+		Fields:     []string{"key0"},
+		Partitions: 1,
+	}
+	if schema != nil {
+		header.RecordSize = schema.recordSize()
+		header.Schema = schema.source
+		header.Fields = schema.indexes
+	}
+	return header
+}
+
+func (h *SampleHeader) encode() ([]byte, error) {
+	line, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(line)) >= h.HeaderSize {
+		return nil, fmt.Errorf("sample header of %d bytes doesn't fit in %d", len(line), h.HeaderSize)
+	}
+	buf := bytes.Repeat([]byte{' '}, int(h.HeaderSize))
+	copy(buf, line)
+	buf[len(buf)-1] = '\n'
+	return buf, nil
+}
+
+func readSampleHeader(r io.ReaderAt, size int64) (*SampleHeader, int64, error) {
+	buf := make([]byte, 1<<20)
+	if size < int64(len(buf)) {
+		buf = buf[:size]
+	}
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	end := bytes.IndexByte(buf[:n], '\n')
+	var header SampleHeader
+	if end < 0 || json.Unmarshal(buf[:end], &header) != nil || header.Format != sampleFormat {
+		return nil, 0, fmt.Errorf("not a sample file")
+	}
+	if header.Version != sampleVersion {
+		return nil, 0, fmt.Errorf("unsupported sample file version %d", header.Version)
+	}
+	if header.HeaderSize != int64(end+1) || header.RecordSize <= 0 || len(header.Fields) == 0 {
+		return nil, 0, fmt.Errorf("invalid sample file header")
+	}
+	if header.Partitions == 0 {
+		header.Partitions = 1
+	}
+
+	records := (size - header.HeaderSize) / header.RecordSize
+	if partial := (size - header.HeaderSize) % header.RecordSize; partial != 0 {
+		log.Printf("Ignoring a partial record of %d bytes at the end of the sample file\n", partial)
+	}
+	if records < header.Count {
+		return nil, 0, fmt.Errorf("sample file has %d records, its header %d", records, header.Count)
+	}
+	if records > header.Count {
+		log.Printf("Sample file has %d records more than its header, it wasn't closed\n", records-header.Count)
+	}
+	return &header, records, nil
+}
+
+type SampleWriter struct {
+	lock   sync.Mutex
+	file   *os.File
+	header SampleHeader
+}
+
+func OpenSampleWriter(path string, header SampleHeader, readOnly bool) (*SampleWriter, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		line, _ := json.Marshal(&header)
+		header.HeaderSize = (int64(len(line))/512 + 1) * 512
+	} else {
+		existing, records, err := readSampleHeader(file, info.Size())
+		if err == nil && (existing.Schema != header.Schema || existing.RecordSize != header.RecordSize) {
+			err = fmt.Errorf("sample file of another schema or record size")
+		}
+		if err == nil && !readOnly && existing.Seed != header.Seed {
+			err = fmt.Errorf("sample file of seed %d, not %d", existing.Seed, header.Seed)
+		}
+		if err == nil && existing.Partitions != header.Partitions {
+			err = fmt.Errorf("sample file of %d partitions, not %d", existing.Partitions, header.Partitions)
+		}
+		if err == nil {
+			existing.Count = records
+			err = file.Truncate(existing.HeaderSize + records*existing.RecordSize)
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		header = *existing
+	}
+
+	w := &SampleWriter{file: file, header: header}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *SampleWriter) pad(line []byte) ([]byte, error) {
+	if int64(len(line)) >= w.header.RecordSize {
+		return nil, fmt.Errorf("sample record of %d bytes doesn't fit in %d", len(line), w.header.RecordSize)
+	}
+	buf := bytes.Repeat([]byte{' '}, int(w.header.RecordSize))
+	copy(buf, line)
+	buf[len(buf)-1] = '\n'
+	return buf, nil
+}
+
+func (w *SampleWriter) Write(records []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n, err := w.file.WriteAt(records, w.header.HeaderSize+w.header.Count*w.header.RecordSize)
+	written := int64(n) / w.header.RecordSize
+	w.header.Count += written
+	return int(written), err
+}
+
+func (w *SampleWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	buf, err := w.header.encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.file.WriteAt(buf, 0)
+	return err
+}
+
+// Reset drops every record.
+func (w *SampleWriter) Reset() error {
+	w.lock.Lock()
+	w.header.Count = 0
+	err := w.file.Truncate(w.header.HeaderSize)
+	w.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (w *SampleWriter) Close() error {
+	err := w.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// SampleRecorder appends the records of all the writers to a sample file from
+// a single goroutine, batch records per write. Every flush interval the
+// header is updated and, with the "flush" sync policy, the file synced. The
+// first write error stops the recording, it is logged and returned to the
+// writers, and the records not written are counted as dropped.
+type SampleRecorder struct {
+	writer   *SampleWriter
+	records  chan []byte
+	flushes  chan chan error
+	done     chan error
+	policy   string
+	recorded uint64
+	written  uint64
+	dropped  uint64
+	lock     sync.Mutex
+	err      error
+	// closing is held by the senders on records, and by Close to close it
+	closing sync.RWMutex
+	closed  bool
+}
+
+func NewSampleRecorder(writer *SampleWriter, batch int, interval time.Duration, policy string) *SampleRecorder {
+	switch policy {
+	case "none", "flush", "close":
+	default:
+		log.Fatalf("Unknown sample sync policy %s\n", policy)
+	}
+	if interval <= 0 {
+		log.Fatalf("Sample flush interval must be positive, not %v\n", interval)
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	r := &SampleRecorder{
+		writer:  writer,
+		records: make(chan []byte, batch*4),
+		flushes: make(chan chan error),
+		done:    make(chan error),
+		policy:  policy,
+	}
+	go r.loop(batch, interval)
+	return r
+}
+
+var errRecorderClosed = fmt.Errorf("sample recorder closed")
+
+// Record queues the record of the JSON object line.
+func (r *SampleRecorder) Record(line []byte) error {
+	record, err := r.writer.pad(line)
+	if err != nil {
+		return err
+	}
+	r.closing.RLock()
+	defer r.closing.RUnlock()
+	if r.closed {
+		return errRecorderClosed
+	}
+	atomic.AddUint64(&r.recorded, 1)
+	if err := r.Err(); err != nil {
+		atomic.AddUint64(&r.dropped, 1)
+		return err
+	}
+	r.records <- record
+	return nil
+}
+
+func (r *SampleRecorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *SampleRecorder) fail(err error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err == nil && err != nil {
+		log.Println("Write sample file failed, dropping the next samples", err)
+		r.err = err
+	}
+	return r.err
+}
+
+// Flush writes the records queued so far and updates the header.
+func (r *SampleRecorder) Flush() error {
+	r.closing.RLock()
+	defer r.closing.RUnlock()
+	if r.closed {
+		return errRecorderClosed
+	}
+	reply := make(chan error)
+	r.flushes <- reply
+	return <-reply
+}
+
+// Close writes the queued records and closes the sample file. The records
+// recorded after it are refused.
+func (r *SampleRecorder) Close() error {
+	r.closing.Lock()
+	if r.closed {
+		r.closing.Unlock()
+		return errRecorderClosed
+	}
+	r.closed = true
+	close(r.records)
+	r.closing.Unlock()
+
+	err := <-r.done
+	if r.policy != "none" {
+		err = r.fail(r.writer.file.Sync())
+	}
+	if cerr := r.writer.Close(); err == nil {
+		err = cerr
+	}
+	dropped := atomic.LoadUint64(&r.dropped)
+	log.Printf("Samples recorded=%d written=%d dropped=%d\n", atomic.LoadUint64(&r.recorded), atomic.LoadUint64(&r.written), dropped)
+	if err != nil && dropped > 0 {
+		err = fmt.Errorf("%s, %d samples dropped", err, dropped)
+	}
+	return err
+}
+
+// Reset writes the records queued so far, and drops them with every record of
+// the sample file.
+func (r *SampleRecorder) Reset() error {
+	if err := r.Flush(); err != nil {
+		return err
+	}
+	return r.fail(r.writer.Reset())
+}
+
+func (r *SampleRecorder) loop(batch int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := make([]byte, 0, batch*int(r.writer.header.RecordSize))
+	write := func() {
+		if len(pending) == 0 {
+			return
+		}
+		n := 0
+		if r.Err() == nil {
+			var err error
+			n, err = r.writer.Write(pending)
+			r.fail(err)
+		}
+		atomic.AddUint64(&r.written, uint64(n))
+		atomic.AddUint64(&r.dropped, uint64(int64(len(pending))/r.writer.header.RecordSize-int64(n)))
+		pending = pending[:0]
+	}
+	add := func(record []byte) {
+		pending = append(pending, record...)
+		if len(pending) >= cap(pending) {
+			write()
+		}
+	}
+	flush := func() error {
+		write()
+		if r.Err() != nil {
+			return r.Err()
+		}
+		err := r.writer.Flush()
+		if err == nil && r.policy == "flush" {
+			err = r.writer.file.Sync()
+		}
+		return r.fail(err)
+	}
+
+	for {
+		select {
+		case record, ok := <-r.records:
+			if !ok {
+				r.done <- flush()
+				return
+			}
+			add(record)
+		case <-ticker.C:
+			flush()
+		case reply := <-r.flushes:
+			// the records queued before the flush are part of it
+			for n := len(r.records); n > 0; n-- {
+				add(<-r.records)
+			}
+			reply <- flush()
+		}
+	}
+}
+
+type SampleReader struct {
+	Header SampleHeader
+	r      io.ReaderAt
+	count  int
+}
+
+func NewSampleReader(r io.ReaderAt, size int64) (*SampleReader, error) {
+	header, records, err := readSampleHeader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &SampleReader{Header: *header, r: r, count: int(records)}, nil
+}
+
+func (s *SampleReader) Len() int {
+	return s.count
+}
+
+func (s *SampleReader) Record(i int) ([]byte, error) {
+	buf := make([]byte, s.Header.RecordSize)
+	n, err := s.r.ReadAt(buf, s.Header.HeaderSize+int64(i)*s.Header.RecordSize)
+	if n < len(buf) {
+		return nil, fmt.Errorf("read sample record %d: %v", i, err)
+	}
+	if buf[len(buf)-1] != '\n' {
+		return nil, fmt.Errorf("corrupt sample record %d", i)
+	}
+	return bytes.TrimRight(buf, " \n"), nil
+}
+
+// KeyPool remembers the sample records of documents written during the mixed
+// phase, so that queries of the same run can look them up. Once full, new keys replace
+// random old ones.
+type KeyPool struct {
+	lock sync.RWMutex
+	keys []string
+	max  int
+}
+
+func NewKeyPool(max int) *KeyPool {
+	return &KeyPool{max: max}
+}
+
+// Add adds key, replacing an old one drawn from rnd once the pool is full.
+func (p *KeyPool) Add(rnd *rand.Rand, key string) {
+	if p.max <= 0 {
+		return
+	}
+	p.lock.Lock()
+	if len(p.keys) < p.max {
+		p.keys = append(p.keys, key)
+	} else {
+		p.keys[rnd.Intn(p.max)] = key
+	}
+	p.lock.Unlock()
+}
 
-	hasher := murmur3.New128()
-	hasher.Write(bytesArray[0:8])
-	r1, r2 := hasher.Sum128()
+func (p *KeyPool) Len() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.keys)
+}
 
-	*(*uint64)(lpointer) = r1
-	*(*uint64)(hpointer) = r2
+func (p *KeyPool) Get(i int) string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.keys[i]
+}
 
-	return bytesArray[:]
+// Chooser picks which of n sample records is queried next.
+type Chooser interface {
+	Next(rnd *rand.Rand, n int) int
 }
 
-func generateRandomHexes() [20]string {
-	var bytes1 []byte = generateMurmur3()
-	var bytes2 []byte = generateMurmur3()
-	var bytes3 []byte = generateMurmur3()
-	var bytes4 []byte = generateMurmur3()
-	var hex1 string = hex.EncodeToString(bytes1)
-	var hex2 string = hex.EncodeToString(bytes2)
-	var hex3 string = hex.EncodeToString(bytes3)
-	var hex4 string = hex.EncodeToString(bytes4)
-	return [20]string{
-		strings.Join([]string{hex1, hex2, hex3, hex4}, ""),
-		strings.Join([]string{hex1, hex2, hex4, hex3}, ""),
-		strings.Join([]string{hex1, hex3, hex2, hex4}, ""),
-		strings.Join([]string{hex1, hex3, hex4, hex2}, ""),
-		strings.Join([]string{hex1, hex4, hex2, hex3}, ""),
-		strings.Join([]string{hex1, hex4, hex3, hex2}, ""),
-		strings.Join([]string{hex2, hex1, hex3, hex4}, ""),
-		strings.Join([]string{hex2, hex1, hex4, hex3}, ""),
-		strings.Join([]string{hex2, hex3, hex1, hex4}, ""),
-		strings.Join([]string{hex2, hex3, hex4, hex1}, ""),
-		strings.Join([]string{hex2, hex4, hex3, hex2}, ""),
-		strings.Join([]string{hex2, hex4, hex2, hex3}, ""),
-		strings.Join([]string{hex3, hex1, hex2, hex4}, ""),
-		strings.Join([]string{hex3, hex1, hex4, hex2}, ""),
-		strings.Join([]string{hex3, hex2, hex1, hex4}, ""),
-		strings.Join([]string{hex3, hex2, hex4, hex1}, ""),
-		strings.Join([]string{hex3, hex4, hex1, hex2}, ""),
-		strings.Join([]string{hex3, hex4, hex2, hex1}, ""),
-		strings.Join([]string{hex4, hex1, hex2, hex3}, ""),
-		strings.Join([]string{hex4, hex1, hex3, hex2}, ""),
+// NewChooser returns the Chooser of the -distribution flag.
+func NewChooser(name string) Chooser {
+	if (name == "zipfian" || name == "latest") && (*zipfTheta <= 0 || *zipfTheta >= 1) {
+		log.Fatalf("-zipf-theta must be in (0, 1)\n")
+	}
+	switch name {
+	case "uniform":
+		return uniformChooser{}
+	case "zipfian":
+		return &scrambledChooser{zipf: &ZipfianChooser{theta: *zipfTheta}}
+	case "latest":
+		return &latestChooser{zipf: &ZipfianChooser{theta: *zipfTheta}}
+	case "hotspot":
+		if *hotFraction <= 0 || *hotFraction > 1 || *hotOps < 0 || *hotOps > 1 {
+			log.Fatalf("-hot-fraction must be in (0, 1] and -hot-ops in [0, 1]\n")
+		}
+		return &hotspotChooser{fraction: *hotFraction, ops: *hotOps}
 	}
+	log.Fatalf("Unknown distribution %s\n", name)
+	return nil
 }
 
-func write(colls []*mgo.Collection, wg *sync.WaitGroup) {
-	var t uint64
-	count := *writeCount
-	for {
-		if t = atomic.AddUint64(&totalWrite, 1); count > 0 && t > count {
-			break
-		}
+type uniformChooser struct{}
 
-		hexes := generateRandomHexes()
-		err := colls[t%uint64(*dbCount)].Insert(bson.M{
-			"_id":   uuid.New(),
-			"key0":  hexes[0],
-			"key1":  hexes[1],
-			"key2":  hexes[2],
-			"key3":  hexes[3],
-			"key4":  hexes[4],
-			"key5":  hexes[5],
-			"key6":  hexes[6],
-			"key7":  hexes[7],
-			"key8":  hexes[8],
-			"key9":  hexes[9],
-			"key10": hexes[10],
-			"key11": hexes[11],
-			"key12": hexes[12],
-			"key13": hexes[13],
-			"key14": hexes[14],
-			"key15": hexes[15],
-			"key16": hexes[16],
-			"key17": hexes[17],
-			"key18": hexes[18],
-			"key19": hexes[19],
-		})
-		if err != nil {
-			log.Println(err)
-			continue
-		}
+func (uniformChooser) Next(rnd *rand.Rand, n int) int {
+	return rnd.Intn(n)
+}
 
-		sampleFile.WriteString(hexes[0])
+// ZipfianChooser picks rank 0 most often, following the zipfian generator of
+// YCSB ("Quickly Generating Billion-Record Synthetic Databases", Gray et al.).
+// The zeta constant is extended incrementally as n grows.
+type ZipfianChooser struct {
+	lock  sync.Mutex
+	theta float64
+	n     int
+	zetan float64
+	eta   float64
+}
 
-		if t%(*frequency) == 0 {
-			log.Println("INSERT", t, float64(*frequency)/time.Since(last).Seconds())
-			last = time.Now()
+func zeta(from, to int, theta, sum float64) float64 {
+	for i := from; i < to; i++ {
+		sum += 1 / math.Pow(float64(i+1), theta)
+	}
+	return sum
+}
+
+func (z *ZipfianChooser) Next(rnd *rand.Rand, n int) int {
+	z.lock.Lock()
+	if n != z.n {
+		if n > z.n {
+			z.zetan = zeta(z.n, n, z.theta, z.zetan)
+		} else {
+			z.zetan = zeta(0, n, z.theta, 0)
 		}
+		z.n = n
+		zeta2 := zeta(0, 2, z.theta, 0)
+		z.eta = (1 - math.Pow(2/float64(n), 1-z.theta)) / (1 - zeta2/z.zetan)
 	}
-	wg.Done()
+	zetan, eta := z.zetan, z.eta
+	z.lock.Unlock()
+
+	u := rnd.Float64()
+	uz := u * zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) && n > 1 {
+		return 1
+	}
+	rank := int(float64(n) * math.Pow(eta*u-eta+1, 1/(1-z.theta)))
+	if rank >= n {
+		rank = n - 1
+	}
+	return rank
+}
+
+// scrambledChooser spreads the popular ranks of a zipfian distribution over
+// the whole sample file instead of its first records.
+type scrambledChooser struct {
+	zipf *ZipfianChooser
+}
+
+func (c *scrambledChooser) Next(rnd *rand.Rand, n int) int {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(c.zipf.Next(rnd, n)))
+	hasher := fnv.New64a()
+	hasher.Write(buf[:])
+	return int(hasher.Sum64() % uint64(n))
 }
 
-func getQueryBody() map[string]string {
-	doc := make(map[string]string)
-	total := int32(len(sampleFileContent) >> 7)
+// latestChooser prefers the records written last.
+type latestChooser struct {
+	zipf *ZipfianChooser
+}
+
+func (c *latestChooser) Next(rnd *rand.Rand, n int) int {
+	return n - 1 - c.zipf.Next(rnd, n)
+}
+
+// hotspotChooser sends ops of the queries to the first fraction of records
+// and the rest to the other records.
+type hotspotChooser struct {
+	fraction float64
+	ops      float64
+}
+
+func (c *hotspotChooser) Next(rnd *rand.Rand, n int) int {
+	hot := int(float64(n) * c.fraction)
+	if hot < 1 {
+		hot = 1
+	}
+	if hot >= n || rnd.Float64() < c.ops {
+		return rnd.Intn(hot)
+	}
+	return hot + rnd.Intn(n-hot)
+}
+
+// sampleCount returns how many records getQueryBody can pick from.
+func sampleCount() int {
+	total := 0
+	if samples != nil {
+		total = samples.Len()
+	}
+	if recentKeys != nil {
+		total += recentKeys.Len()
+	}
+	return total
+}
+
+// pickSample returns a random sample record, either from the sample file or
+// from recentKeys.
+func pickSample(rnd *rand.Rand) map[string]interface{} {
+	total := sampleCount()
 	if total == 0 {
 		log.Fatalf("No data in %s to be read", *samplePath)
 	}
-	randPos := rand.Int31n(total)
-	buf := sampleFileContent[(int64(randPos) << 7):(int64(randPos)<<7 + 128)]
-	hex1 := string(buf[0:32])
-	hex2 := string(buf[32:64])
-	hex3 := string(buf[64:96])
-	hex4 := string(buf[96:128])
-	keyCount := rand.Int31n(5) + 1
+	randPos := chooser.Next(rnd, total)
+	fileTotal := 0
+	if samples != nil {
+		fileTotal = samples.Len()
+	}
+
+	var line []byte
+	if randPos >= fileTotal {
+		line = []byte(recentKeys.Get(randPos - fileTotal))
+	} else {
+		var err error
+		line, err = samples.Record(randPos)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var record map[string]interface{}
+	err := json.Unmarshal(line, &record)
+	if err != nil {
+		log.Fatalf("Parse sample record %s failed: %s\n", line, err)
+	}
+	return record
+}
+
+// openSamples loads the sample file for queries, once, with the records
+// written so far.
+func openSamples() {
+	if samples != nil {
+		return
+	}
+	err := recorder.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(*samplePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	samples, err = NewSampleReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		log.Fatalf("%s: %s\n", *samplePath, err)
+	}
+}
+
+// missKey turns key0 of a record into the key0 of a record which can't
+// exist: every keyN is made of its 32 characters hex parts, and each of them
+// starts with 'x', which is not a hex digit.
+func missKey(key string) string {
+	b := []byte(key)
+	for i := 0; i < len(b); i += 32 {
+		b[i] = 'x'
+	}
+	return string(b)
+}
+
+// getQueryBody returns the condition of a query for a sample record, or for
+// a record which doesn't exist if miss is set, and the partition of -dbs and
+// -colls it goes to.
+func getQueryBody(rnd *rand.Rand, miss bool) (bson.M, int) {
+	if schema != nil && miss {
+		record := schema.MissRecord(rnd)
+		return schema.Query(rnd, record, queryMinKeys, queryMaxKeys), partition(record)
+	}
+	return recordQuery(rnd, pickSample(rnd), miss)
+}
+
+// recordQuery returns a query for the document of the sample record, or for
+// one which can't exist when miss is set, and the partition it goes to.
+func recordQuery(rnd *rand.Rand, record map[string]interface{}, miss bool) (bson.M, int) {
+	if schema != nil {
+		return schema.Query(rnd, record, queryMinKeys, queryMaxKeys), partition(record)
+	}
+
+	doc := bson.M{}
+	key, _ := record["key0"].(string)
+	if len(key) != 128 {
+		log.Fatalf("Sample record without a key0 of 128 hex characters in %s\n", *samplePath)
+	}
+	if miss {
+		key = missKey(key)
+	}
+	p := partition(map[string]interface{}{"key0": key})
+	hex1 := key[0:32]
+	hex2 := key[32:64]
+	hex3 := key[64:96]
+	hex4 := key[96:128]
+	keyCount := int32(queryMinKeys) + rnd.Int31n(int32(queryMaxKeys-queryMinKeys+1))
 	for i := int32(0); i < keyCount; i++ {
-		keyNum := rand.Int31n(20)
+		keyNum := rnd.Int31n(20)
 		switch keyNum {
 		case 0:
 			doc["key0"] = strings.Join([]string{hex1, hex2, hex3, hex4}, "")
@@ -198,43 +1903,420 @@ func getQueryBody() map[string]string {
 			doc["key19"] = strings.Join([]string{hex4, hex1, hex3, hex2}, "")
 		}
 	}
-	return doc
+	return doc, p
 }
 
-func query(colls []*mgo.Collection, wg *sync.WaitGroup) {
-	var t uint64
-	var results []map[string]string
+// partition returns the index of the database and collection of -dbs and
+// -colls the document of a sample record is in, by a hash of its key0, or of
+// its first indexed field with a schema.
+func partition(record map[string]interface{}) int {
+	n := *dbCount * *collCount
+	if n == 1 {
+		return 0
+	}
+	path := "key0"
+	if schema != nil {
+		path = schema.indexes[0]
+	}
+	// the value is read back from JSON for queries
+	key, _ := json.Marshal(record[path])
+	return int(murmur3.Sum64(key) % uint64(n))
+}
+
+// partitionName returns the name of the ith of n databases or collections.
+func partitionName(base string, i, n int) string {
+	if n == 1 {
+		return base
+	}
+	return base + "_" + strconv.Itoa(i)
+}
 
+func query(colls []*mgo.Collection, wg *sync.WaitGroup, rnd *rand.Rand, quota uint64, stats *Stats) {
+	var t uint64
 	count := *queryCount
-	for {
-		if t = atomic.AddUint64(&totalQuery, 1); count > 0 && t > count {
+	for done := uint64(0); done < quota; done++ {
+		if t = atomic.AddUint64(&totalQuery, 1); (count > 0 && t > count) || phase.Over() {
 			break
 		}
 
-		query := getQueryBody()
-		err := colls[t%uint64(*dbCount)].Find(query).All(&results)
-		if err != nil {
-			log.Println(err)
-			continue
+		if queryOne(colls, rnd, stats) && t%(*frequency) == 0 {
+			logThroughput("QUERY", t)
+		}
+	}
+	wg.Done()
+}
+
+// queryOne runs one query, -miss-ratio of them for records which don't
+// exist, recorded in the miss stats.
+func queryOne(colls []*mgo.Collection, rnd *rand.Rand, stats *Stats) bool {
+	var results []bson.M
+
+	miss := *missRatio > 0 && rnd.Float64() < *missRatio
+	if miss {
+		stats = stats.MissStats()
+	}
+
+	query, p := getQueryBody(rnd, miss)
+	start := pacer.Wait()
+	err := colls[p].Find(query).All(&results)
+	stats.Record(start)
+	if err != nil {
+		log.Println(err)
+		stats.RecordError(start, errorCode(err))
+		return false
+	}
+	if miss && len(results) != 0 {
+		log.Printf("Expected the query will got no record, but got %d\nQuery Condition: %v\n", len(results), query)
+		stats.RecordError(start, wrongResultCount)
+		return false
+	} else if !miss && (len(results) == 0 || schema == nil && len(results) != 1) {
+		log.Printf("Expected the query will got 1 record, but got %d\nQuery Condition: %v\n", len(results), query)
+		stats.RecordError(start, wrongResultCount)
+		return false
+	}
+	return true
+}
+
+// mixed runs queries and inserts from the same worker, readRatio of the
+// operations are queries. It only inserts until something can be queried.
+func mixed(colls []*mgo.Collection, wg *sync.WaitGroup, rnd *rand.Rand, quota uint64, count uint64, readRatio float64, writeStats, queryStats *Stats) {
+	var t uint64
+	for done := uint64(0); done < quota; done++ {
+		if t = atomic.AddUint64(&totalMixed, 1); (count > 0 && t > count) || phase.Over() {
+			break
 		}
-		if len(results) != 1 {
-			log.Printf("Expected the query will got 1 record, but got %d\nQuery Condition: %v\n", len(results), query)
+
+		var ok bool
+		if rnd.Float64() < readRatio && sampleCount() > 0 {
+			ok = queryOne(colls, rnd, queryStats)
+		} else {
+			ok = writeOne(colls, rnd, writeStats)
 		}
-		if t%(*frequency) == 0 {
-			log.Println("QUERY", t, float64(*frequency)/time.Since(last).Seconds())
-			last = time.Now()
+		if ok && t%(*frequency) == 0 {
+			logThroughput("MIXED", t)
 		}
 	}
 	wg.Done()
 }
 
-func ensureIndexes(coll *mgo.Collection) {
+// Scenario is a multi-phase workload loaded from a YAML or JSON file by
+// -scenario. Phases run in order.
+type Scenario struct {
+	Phases []*PhaseConfig `yaml:"phases"`
+}
+
+// PhaseConfig describes one phase of a Scenario. Kind is one of load, ramp,
+// steady or spike, a ramp phase moves the rate from Rate to RateTo over its
+// duration. ReadRatio is the fraction of queries, so a load phase is 0.
+type PhaseConfig struct {
+	Name        string        `yaml:"name"`
+	Kind        string        `yaml:"kind"`
+	Concurrency int           `yaml:"concurrency"`
+	Rate        float64       `yaml:"rate"`
+	RateTo      float64       `yaml:"rate_to"`
+	Arrival     string        `yaml:"arrival"`
+	ReadRatio   float64       `yaml:"read_ratio"`
+	Count       uint64        `yaml:"count"`
+	Duration    time.Duration `yaml:"duration"`
+	Warmup      time.Duration `yaml:"warmup"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+	MinKeys     int           `yaml:"min_keys"`
+	MaxKeys     int           `yaml:"max_keys"`
+}
+
+func loadScenario(path string) *Scenario {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var scenario Scenario
+	err = yaml.Unmarshal(body, &scenario)
+	if err != nil {
+		log.Fatalf("Parse scenario %s failed: %s\n", path, err)
+	}
+	if len(scenario.Phases) == 0 {
+		log.Fatalf("No phase in scenario %s\n", path)
+	}
+
+	for i, p := range scenario.Phases {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("phase%d", i)
+		}
+		switch p.Kind {
+		case "":
+			p.Kind = "steady"
+		case "load", "steady", "spike":
+		case "ramp":
+			if p.Duration <= 0 || p.RateTo <= 0 {
+				log.Fatalf("Ramp phase %s needs duration and rate_to\n", p.Name)
+			}
+		default:
+			log.Fatalf("Unknown kind %s of phase %s\n", p.Kind, p.Name)
+		}
+		if p.Count == 0 && p.Duration <= 0 {
+			log.Fatalf("Phase %s needs count or duration\n", p.Name)
+		}
+		if p.Concurrency <= 0 {
+			p.Concurrency = *NumberGoroutine
+		}
+		if p.Arrival == "" {
+			p.Arrival = *arrival
+		}
+		if p.MinKeys <= 0 {
+			p.MinKeys = 1
+		}
+		if p.MaxKeys <= 0 {
+			p.MaxKeys = 5
+		}
+		if p.MaxKeys < p.MinKeys {
+			p.MaxKeys = p.MinKeys
+		}
+		if p.MaxKeys > 20 {
+			log.Fatalf("Phase %s queries at most 20 keys\n", p.Name)
+		}
+	}
+	return &scenario
+}
+
+func (p *PhaseConfig) pacer() *Pacer {
+	if p.Kind == "ramp" {
+		return NewRampPacer(p.Rate, p.RateTo, p.Duration, p.Arrival)
+	}
+	return NewPacer(p.Rate, p.Arrival)
+}
+
+// runScenario runs every phase of scenario with the mixed worker, so a phase
+// inserts, queries or both depending on its read ratio.
+func runScenario(collsList [][]*mgo.Collection, scenario *Scenario) {
+	var wg sync.WaitGroup
+	for _, p := range scenario.Phases {
+		if stopped() {
+			break
+		}
+		log.Printf("Phase %s (%s): concurrency=%d rate=%v read_ratio=%v\n", p.Name, p.Kind, p.Concurrency, p.Rate, p.ReadRatio)
+		queryMinKeys, queryMaxKeys = p.MinKeys, p.MaxKeys
+		atomic.StoreUint64(&totalMixed, 0)
+
+		wg.Add(p.Concurrency)
+
+		writeSampler := StartSampler()
+		querySampler := StartSampler()
+		writeStats := make([]*Stats, p.Concurrency)
+		queryStats := make([]*Stats, p.Concurrency)
+		last = time.Now().UnixNano()
+		phase = NewPhase(p.Duration, p.Warmup, p.Cooldown)
+		pacer = p.pacer()
+		for i := 0; i < p.Concurrency; i++ {
+			writeStats[i] = NewStats()
+			writeStats[i].Sampler = writeSampler
+			queryStats[i] = NewStats()
+			queryStats[i].Sampler = querySampler
+			go mixed(collsList[i%len(collsList)], &wg, newRand(), workerQuota(p.Count, i, p.Concurrency), p.Count, p.ReadRatio, writeStats[i], queryStats[i])
+		}
+		wg.Wait()
+		if p.ReadRatio < 1 {
+			report(p.Name, "INSERT", mergeStats(writeStats), writeSampler)
+		} else {
+			writeSampler.Stop()
+		}
+		if p.ReadRatio > 0 {
+			report(p.Name, "QUERY", mergeStats(queryStats), querySampler)
+		} else {
+			querySampler.Stop()
+		}
+	}
+}
+
+// codeNamespaceNotFound is the error code of dropping a missing collection.
+const codeNamespaceNotFound = 26
+
+// dropPartitions drops every partition of -dbs and -colls.
+func dropPartitions(colls []*mgo.Collection) {
+	for _, coll := range colls {
+		err := coll.DropCollection()
+		if err != nil && errorCode(err) != codeNamespaceNotFound {
+			log.Fatalf("Drop %s failed %s\n", coll.FullName, err)
+		}
+	}
+}
+
+// ensureIndexes ensures the indexes on every partition of -dbs and -colls.
+func ensureIndexes(colls []*mgo.Collection) {
+	keys := make([]string, 20)
 	for i := 0; i < 20; i++ {
-		err := coll.EnsureIndexKey("key" + strconv.Itoa(i))
-		if err != nil {
-			panic(err)
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	if schema != nil {
+		keys = schema.indexes
+	}
+	for _, coll := range colls {
+		for _, key := range keys {
+			err := coll.EnsureIndexKey(key)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+// runWrite runs the write phase, reported as name.
+func runWrite(name string, collsList [][]*mgo.Collection) {
+	var wg sync.WaitGroup
+
+	atomic.StoreUint64(&totalWrite, 0)
+	wg.Add(*NumberGoroutine)
+
+	sampler := StartSampler()
+	batchSampler := StartSampler()
+	stats := make([]*Stats, *NumberGoroutine)
+	batchStats := make([]*Stats, *NumberGoroutine)
+	last = time.Now().UnixNano()
+	phase = NewPhase(*duration, *warmup, *cooldown)
+	pacer = NewPacer(*rate, *arrival)
+	for i := 0; i < *NumberGoroutine; i++ {
+		stats[i] = NewStats()
+		stats[i].Sampler = sampler
+		batchStats[i] = NewStats()
+		batchStats[i].Sampler = batchSampler
+		if *batchSize > 1 {
+			go writeBulk(collsList[i], &wg, newRand(), workerQuota(*writeCount, i, *NumberGoroutine), batchStats[i], stats[i])
+		} else {
+			go write(collsList[i], &wg, newRand(), workerQuota(*writeCount, i, *NumberGoroutine), stats[i])
+		}
+	}
+	wg.Wait()
+	if *batchSize > 1 {
+		report(name, "BULK", mergeStats(batchStats), batchSampler)
+	} else {
+		batchSampler.Stop()
+	}
+	report(name, "INSERT", mergeStats(stats), sampler)
+}
+
+// beforeQueryHooks are the hooks -before-query may run before the query
+// phase, once the writes are done.
+var beforeQueryHooks = map[string]func(collsList [][]*mgo.Collection) error{
+	"signal":  waitForSignal,
+	"delay":   waitForDelay,
+	"indexes": waitForIndexBuilds,
+	"warmup":  warmupCache,
+}
+
+// parseBeforeQuery checks the hooks of -before-query. SIGUSR1 is caught from
+// here on when waiting for it, a signal sent during the writes lets the query
+// phase start as soon as they are done.
+func parseBeforeQuery() []string {
+	if *beforeQuery == "" {
+		return nil
+	}
+	hooks := strings.Split(*beforeQuery, ",")
+	for _, name := range hooks {
+		if _, ok := beforeQueryHooks[name]; !ok {
+			log.Fatalf("Unknown -before-query hook %s\n", name)
+		}
+		if name == "signal" && querySignal == nil {
+			querySignal = make(chan os.Signal, 1)
+			signal.Notify(querySignal, syscall.SIGUSR1)
+		}
+	}
+	return hooks
+}
+
+func runBeforeQuery(hooks []string, collsList [][]*mgo.Collection) {
+	for _, name := range hooks {
+		if stopped() {
+			return
+		}
+		start := time.Now()
+		if err := beforeQueryHooks[name](collsList); err != nil {
+			log.Fatalf("Before query hook %s failed: %s\n", name, err)
+		}
+		log.Printf("Before query hook %s done in %v\n", name, time.Since(start))
+	}
+}
+
+func waitForSignal(collsList [][]*mgo.Collection) error {
+	log.Printf("Waiting for SIGUSR1 to start the query phase (kill -USR1 %d)\n", os.Getpid())
+	select {
+	case <-querySignal:
+	case <-stopping:
+	}
+	return nil
+}
+
+func waitForDelay(collsList [][]*mgo.Collection) error {
+	select {
+	case <-time.After(*queryDelay):
+	case <-stopping:
+	}
+	return nil
+}
+
+// waitForIndexBuilds polls currentOp until no index build is in progress.
+func waitForIndexBuilds(collsList [][]*mgo.Collection) error {
+	admin := collsList[0][0].Database.Session.DB("admin")
+	cmd := bson.D{
+		{Name: "currentOp", Value: 1},
+		{Name: "$or", Value: []bson.M{
+			{"command.createIndexes": bson.M{"$exists": true}},
+			{"msg": bson.RegEx{Pattern: "^Index Build"}},
+		}},
+	}
+	for {
+		var ops struct {
+			Inprog []bson.M `bson:"inprog"`
 		}
+		if err := admin.Run(cmd, &ops); err != nil {
+			return err
+		}
+		if len(ops.Inprog) == 0 {
+			return nil
+		}
+		for _, op := range ops.Inprog {
+			log.Printf("Index build in progress on %v: %v\n", op["ns"], op["msg"])
+		}
+		select {
+		case <-time.After(*indexPoll):
+		case <-stopping:
+			return nil
+		}
+	}
+}
+
+// warmupCache queries every record of the sample file once from all the
+// goroutines, without recording them, to load their documents and index
+// entries into the cache of Mongo.
+func warmupCache(collsList [][]*mgo.Collection) error {
+	var (
+		wg     sync.WaitGroup
+		failed uint64
+	)
+	wg.Add(*NumberGoroutine)
+	for i := 0; i < *NumberGoroutine; i++ {
+		go func(i int, rnd *rand.Rand) {
+			defer wg.Done()
+			var results []bson.M
+			for n := i; n < samples.Len() && !stopped(); n += *NumberGoroutine {
+				line, err := samples.Record(n)
+				if err != nil {
+					log.Fatal(err)
+				}
+				var record map[string]interface{}
+				if err = json.Unmarshal(line, &record); err != nil {
+					log.Fatalf("Parse sample record %s failed: %s\n", line, err)
+				}
+				query, p := recordQuery(rnd, record, false)
+				err = collsList[i][p].Find(query).All(&results)
+				if err != nil {
+					log.Println(err)
+					atomic.AddUint64(&failed, 1)
+				}
+			}
+		}(i, newRand())
 	}
+	wg.Wait()
+	log.Printf("Warmup queried %d sample records, %d failed\n", samples.Len(), failed)
+	return nil
 }
 
 func main() {
@@ -245,70 +2327,152 @@ func main() {
 	)
 
 	flag.Parse()
+	handleSignals()
+	setFlags = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	hooks := parseBeforeQuery()
+	if *interval <= 0 {
+		log.Fatal("-interval must be positive")
+	}
+	if *dbCount < 1 || *collCount < 1 {
+		log.Fatal("-dbs and -colls must be at least 1")
+	}
+	mode, err := parseReadMode(*readMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var concerns []string
+	if *writeConcerns != "" {
+		concerns = strings.Split(*writeConcerns, ",")
+		if !*dropColls {
+			log.Fatal("-write-concerns drops the collections before each of its runs, confirm it with -drop")
+		}
+		if phaseEnabled("qr", *queryCount) {
+			log.Fatal("-write-concerns drops the collections between its runs, it can't be combined with -qr")
+		}
+	}
+	for _, spec := range append(concerns, flagWriteConcern()) {
+		if _, err := parseWriteConcern(spec); spec != "" && err != nil {
+			log.Fatal(err)
+		}
+	}
+	result = NewResult("mongo-benchmark")
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	chooser = NewChooser(*distribution)
+	if *schemaPath != "" {
+		schema = loadSchema(*schemaPath)
+	}
 
-	sampleFile, err = os.OpenFile(*samplePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	header := newSampleHeader(schema, *seed)
+	header.Partitions = *dbCount * *collCount
+	readOnly := *scenarioPath == "" && !phaseEnabled("qw", *writeCount)
+	sampleWriter, err := OpenSampleWriter(*samplePath, header, readOnly)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer sampleFile.Close()
+	recorder = NewSampleRecorder(sampleWriter, *sampleBatch, *sampleFlush, *sampleSync)
+	defer func() {
+		if err := recorder.Close(); err != nil {
+			log.Println("Close sample file failed", err)
+		}
+	}()
 
 	if *verbose {
 		logger := log.New(os.Stderr, "INFO", log.LstdFlags)
 		mgo.SetLogger(logger)
 		mgo.SetDebug(*debug)
 	}
-	collsList := make([][]*mgo.Collection, *NumberGoroutine)
-	for i := 0; i < *NumberGoroutine; i++ {
+	var scenario *Scenario
+	sessionCount := *NumberGoroutine
+	if *scenarioPath != "" {
+		scenario = loadScenario(*scenarioPath)
+		for _, p := range scenario.Phases {
+			if p.Concurrency > sessionCount {
+				sessionCount = p.Concurrency
+			}
+		}
+	}
+
+	collsList := make([][]*mgo.Collection, sessionCount)
+	for i := 0; i < sessionCount; i++ {
 		session, err = mgo.DialWithTimeout(*host, 1*time.Minute)
 		if err != nil {
 			log.Fatal(err)
 		}
 		session.SetSyncTimeout(10 * time.Minute)
 		session.SetSocketTimeout(10 * time.Minute)
-		session.SetMode(mgo.Eventual, true)
+		session.SetMode(mode, true)
+		if spec := flagWriteConcern(); spec != "" {
+			safe, _ := parseWriteConcern(spec)
+			session.SetSafe(safe)
+		}
 		defer session.Close()
-		colls := make([]*mgo.Collection, *dbCount)
+		colls := make([]*mgo.Collection, 0, *dbCount**collCount)
 		for j := 0; j < *dbCount; j++ {
-			colls[j] = session.DB(*db).C(*coll)
+			for k := 0; k < *collCount; k++ {
+				colls = append(colls, session.DB(partitionName(*db, j, *dbCount)).C(partitionName(*coll, k, *collCount)))
+			}
 		}
 		collsList[i] = colls
 	}
 
-	if *writeCount > 0 {
-		ensureIndexes(collsList[0][0])
+	if scenario != nil {
+		ensureIndexes(collsList[0])
 
-		wg.Add(*NumberGoroutine)
+		openSamples()
+		recentKeys = NewKeyPool(*recentKeysMax)
 
-		last = time.Now()
-		for i := 0; i < *NumberGoroutine; i++ {
-			go write(collsList[i], &wg)
-		}
-		wg.Wait()
+		runScenario(collsList, scenario)
+		writeResult()
+		return
 	}
 
-	if *queryCount > 0 {
-		file, err := os.OpenFile(*samplePath, os.O_RDONLY, 0)
-		if err != nil {
-			log.Fatal(err)
+	if phaseEnabled("qw", *writeCount) {
+		if len(concerns) == 0 {
+			ensureIndexes(collsList[0])
+			runWrite("write", collsList)
 		}
-
-		sampleFileContent, err = ioutil.ReadAll(file)
-		file.Close()
-		if err != nil {
-			log.Fatal(err)
+		for _, spec := range concerns {
+			if stopped() {
+				break
+			}
+			// every write concern starts from the same empty collections,
+			// and the sample file keeps the documents of the last one only
+			dropPartitions(collsList[0])
+			if err := recorder.Reset(); err != nil {
+				log.Fatal(err)
+			}
+			ensureIndexes(collsList[0])
+			safe, _ := parseWriteConcern(spec)
+			for _, colls := range collsList {
+				colls[0].Database.Session.SetSafe(safe)
+			}
+			log.Println("Write concern", spec)
+			runWrite("write "+spec, collsList)
 		}
+	}
 
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Println("Press Enter to continue ...")
-		_, _ = reader.ReadString('\n')
+	if phaseEnabled("qr", *queryCount) {
+		openSamples()
+		runBeforeQuery(hooks, collsList)
 
 		wg.Add(*NumberGoroutine)
 
-		last = time.Now()
+		sampler := StartSampler()
+		stats := make([]*Stats, *NumberGoroutine)
+		last = time.Now().UnixNano()
+		phase = NewPhase(*duration, *warmup, *cooldown)
+		pacer = NewPacer(*rate, *arrival)
 		for i := 0; i < *NumberGoroutine; i++ {
-			go query(collsList[i], &wg)
+			stats[i] = NewStats()
+			stats[i].Sampler = sampler
+			go query(collsList[i], &wg, newRand(), workerQuota(*queryCount, i, *NumberGoroutine), stats[i])
 		}
 		wg.Wait()
+		report("query", "QUERY", mergeStats(stats), sampler)
 	}
+
+	writeResult()
 }
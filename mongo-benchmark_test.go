@@ -0,0 +1,72 @@
+// Run with go test mongo-benchmark.go mongo-benchmark_test.go, every program
+// of this directory is its own main package.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestBulkCaseFailures(t *testing.T) {
+	dup := &mgo.LastError{Code: 11000}
+	tests := []struct {
+		name    string
+		cases   []mgo.BulkErrorCase
+		ordered bool
+		want    map[int]int
+	}{
+		{"ordered", []mgo.BulkErrorCase{{Index: 2, Err: dup}}, true,
+			map[int]int{2: 11000, 3: skippedInBatch, 4: skippedInBatch}},
+		{"unordered", []mgo.BulkErrorCase{{Index: 2, Err: dup}, {Index: 4, Err: dup}}, false,
+			map[int]int{2: 11000, 4: 11000}},
+		{"ordered from the first", []mgo.BulkErrorCase{{Index: 3, Err: dup}, {Index: 1, Err: dup}}, true,
+			map[int]int{1: 11000, 2: skippedInBatch, 3: 11000, 4: skippedInBatch}},
+		{"last", []mgo.BulkErrorCase{{Index: 4, Err: dup}}, true,
+			map[int]int{4: 11000}},
+		{"without index", []mgo.BulkErrorCase{{Index: -1, Err: errors.New("EOF")}}, false,
+			map[int]int{0: 0, 1: 0, 2: 0, 3: 0, 4: 0}},
+	}
+	for _, test := range tests {
+		if got := bulkCaseFailures(test.cases, 5, test.ordered); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if got := bulkFailures(nil, 5); len(got) != 0 {
+		t.Errorf("no error: %v", got)
+	}
+	if got := bulkFailures(&mgo.QueryError{Code: 50}, 2); !reflect.DeepEqual(got, map[int]int{0: 50, 1: 50}) {
+		t.Errorf("not a BulkError: %v", got)
+	}
+}
+
+func TestParseWriteConcern(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *mgo.Safe
+	}{
+		{"1", &mgo.Safe{W: 1}},
+		{"majority", &mgo.Safe{WMode: "majority"}},
+		{"majority:j", &mgo.Safe{WMode: "majority", J: true}},
+		{"majority:j:5s", &mgo.Safe{WMode: "majority", J: true, WTimeout: 5000}},
+		{"2:1500ms", &mgo.Safe{W: 2, WTimeout: 1500}},
+		{"dc", &mgo.Safe{WMode: "dc"}},
+		{"0", nil},
+	}
+	for _, test := range tests {
+		got, err := parseWriteConcern(test.spec)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseWriteConcern(%s) = %+v, %v, want %+v", test.spec, got, err, test.want)
+		}
+	}
+
+	for _, spec := range []string{"0:j", "1:x", "majority:5"} {
+		if _, err := parseWriteConcern(spec); err == nil {
+			t.Errorf("parseWriteConcern(%s) succeeded", spec)
+		}
+	}
+}